@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultServerCacheTTL = 5 * time.Minute
+
+// serverCache remembers the last auto-selected server so repeated runs do not
+// probe the whole list every time.
+type serverCache struct {
+	URL        string    `yaml:"url"`
+	SelectedAt time.Time `yaml:"selected_at"`
+	// Region is the -region the server was selected for, so a run asking for
+	// another region selects again.
+	Region string `yaml:"region,omitempty"`
+	// List identifies the server list the server was selected from, so a run
+	// with another -config, or after the list was edited, selects again.
+	List string `yaml:"list,omitempty"`
+}
+
+func serverCachePath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".ispeed-cache.yaml"), nil
+}
+
+// selectServer reuses the cached server when it is younger than opts.CacheTTL
+// and still answers a ping, and otherwise runs full selection and caches the
+// winner. -no-cache skips the lookup but still refreshes the cache.
+func selectServer(cfg ispeed.ClientConfig, opts cliOptions) (string, error) {
+	list := serverListKey(opts.ConfigFile)
+	if opts.CacheTTL > 0 && !opts.NoCache {
+		if cached, ok := loadServerCache(opts.CacheTTL); ok && cached.Region == opts.Region && cached.List == list {
+			client := &http.Client{Timeout: 4 * time.Second}
+			if _, err := ispeed.PingOnce(context.Background(), client, cached.URL); err == nil {
+				return cached.URL, nil
+			}
+			log.Printf("[WARN] cached server %s is unreachable, selecting again", cached.URL)
+			clearServerCache()
+		}
+	}
+
+	selected, err := pickFastestServer(cfg, opts.ConfigFile, opts.Region)
+	if err != nil {
+		return "", err
+	}
+	if opts.CacheTTL > 0 {
+		saveServerCache(serverCache{URL: selected, SelectedAt: time.Now().UTC(), Region: opts.Region, List: list})
+	}
+	return selected, nil
+}
+
+// serverListKey hashes the servers in the list at configFile, so the cache
+// can tell whether a cached selection came from the same list. An unreadable
+// list yields "", which matches no cache written from a real one.
+func serverListKey(configFile string) string {
+	list, err := loadServerList(configFile)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.New()
+	for _, server := range list.Servers {
+		fmt.Fprintf(hash, "%s\n%s\n", server.URL, server.Region)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func loadServerCache(ttl time.Duration) (serverCache, bool) {
+	path, err := serverCachePath()
+	if err != nil {
+		return serverCache{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return serverCache{}, false
+	}
+	var cached serverCache
+	if err := yaml.Unmarshal(data, &cached); err != nil || cached.URL == "" {
+		return serverCache{}, false
+	}
+	if time.Since(cached.SelectedAt) > ttl {
+		return serverCache{}, false
+	}
+	return cached, true
+}
+
+func saveServerCache(cached serverCache) {
+	path, err := serverCachePath()
+	if err != nil {
+		log.Printf("[ERROR] Failed to resolve cache path: %v", err)
+		return
+	}
+	data, err := yaml.Marshal(cached)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode server cache: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Printf("[ERROR] Failed to write server cache: %v", err)
+	}
+}
+
+func clearServerCache() {
+	path, err := serverCachePath()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] Failed to remove server cache: %v", err)
+	}
+}
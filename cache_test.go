@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+func TestServerCacheKeyedByList(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	writeList := func(name string, server *httptest.Server) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		data := fmt.Sprintf("servers:\n  - name: %s\n    url: %s\n", name, server.URL)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first := httptest.NewServer(ispeed.ServerHandler(ispeed.ServerConfig{}))
+	defer first.Close()
+	second := httptest.NewServer(ispeed.ServerHandler(ispeed.ServerConfig{}))
+	defer second.Close()
+
+	opts := cliOptions{CacheTTL: time.Hour, ConfigFile: writeList("first", first)}
+	for _, tt := range []struct {
+		name       string
+		configFile string
+		want       string
+	}{
+		{"first list", opts.ConfigFile, first.URL},
+		{"same list from cache", opts.ConfigFile, first.URL},
+		{"other list", writeList("second", second), second.URL},
+	} {
+		opts.ConfigFile = tt.configFile
+		got, err := selectServer(ispeed.ClientConfig{}, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: selected %s, want %s", tt.name, got, tt.want)
+		}
+		cached, ok := loadServerCache(opts.CacheTTL)
+		if !ok || cached.URL != tt.want || cached.List != serverListKey(tt.configFile) {
+			t.Errorf("%s: cache holds %+v", tt.name, cached)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// envFlags maps environment variables to the flags they stand in for, so cron
+// and CI jobs can configure a run without a long command line. A variable is
+// also ignored when its flag's alternative, if any, was given.
+var envFlags = []struct {
+	env         string
+	flag        string
+	alternative string
+}{
+	{"ISPEED_URL", "url", ""},
+	{"ISPEED_DURATION", "duration", ""},
+	{"ISPEED_STREAMS", "streams", ""},
+	{"ISPEED_CHUNK_SIZE", "chunk-size", ""},
+	{"ISPEED_DOWNLOAD_MB", "download-mb", "total-download-mb"},
+	{"ISPEED_UPLOAD_MB", "upload-mb", ""},
+	{"ISPEED_PING_COUNT", "ping-count", ""},
+	{"ISPEED_TIMEOUT", "timeout", ""},
+	{"ISPEED_JSON", "json", ""},
+}
+
+// applyEnvFlags sets every flag that was not given on the command line from
+// its environment variable, if present. It runs after flag.Parse, so flags
+// win over the environment, which wins over defaults.
+func applyEnvFlags() error {
+	for _, entry := range envFlags {
+		value, ok := os.LookupEnv(entry.env)
+		if !ok || flagSet(entry.flag) || (entry.alternative != "" && flagSet(entry.alternative)) {
+			continue
+		}
+		if err := flag.Set(entry.flag, value); err != nil {
+			return fmt.Errorf("%s=%q: %w", entry.env, value, err)
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nEnvironment (a flag on the command line wins over its variable, which wins over the default):")
+	for _, entry := range envFlags {
+		fmt.Fprintf(out, "  %-20s -%s\n", entry.env, entry.flag)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+// withFlags swaps in a fresh command line with the download size flags and
+// parses args into it.
+func withFlags(t *testing.T, args ...string) (downloadMB, totalDownloadMB *int) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("ispeed", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	downloadMB = flag.Int("download-mb", 40, "")
+	totalDownloadMB = flag.Int("total-download-mb", 0, "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return downloadMB, totalDownloadMB
+}
+
+func TestEnvFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantMB    int
+		wantTotal int
+	}{
+		{"env over default", nil, 10, 0},
+		{"flag over env", []string{"-download-mb", "20"}, 20, 0},
+		{"alternative flag over env", []string{"-total-download-mb", "30"}, 40, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ISPEED_DOWNLOAD_MB", "10")
+			downloadMB, totalDownloadMB := withFlags(t, tt.args...)
+			if err := applyEnvFlags(); err != nil {
+				t.Fatal(err)
+			}
+			if *downloadMB != tt.wantMB || *totalDownloadMB != tt.wantTotal {
+				t.Errorf("download-mb %d, total-download-mb %d; want %d, %d", *downloadMB, *totalDownloadMB, tt.wantMB, tt.wantTotal)
+			}
+			if tt.wantTotal > 0 && flagSet("download-mb") {
+				t.Error("download-mb counts as set, which parseFlags reports as a conflict")
+			}
+		})
+	}
+}
+
+func TestEnvFlagsInvalid(t *testing.T) {
+	t.Setenv("ISPEED_DOWNLOAD_MB", "lots")
+	withFlags(t)
+	if err := applyEnvFlags(); err == nil {
+		t.Fatal("applyEnvFlags accepted a non-numeric ISPEED_DOWNLOAD_MB")
+	}
+}
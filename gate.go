@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+const (
+	gateAll      = "all"
+	gateDownload = "download"
+	gateUpload   = "upload"
+	gatePing     = "ping"
+)
+
+// thresholds are the pass/fail limits for CI use. Zero disables a limit.
+type thresholds struct {
+	MinDownload float64
+	MinUpload   float64
+	MaxPing     time.Duration
+	// Gate names the metric whose failure sets the exit status; the others
+	// are still reported.
+	Gate string
+}
+
+type thresholdFailure struct {
+	Metric  string
+	Message string
+}
+
+func validGate(gate string) bool {
+	switch gate {
+	case gateAll, gateDownload, gateUpload, gatePing:
+		return true
+	}
+	return false
+}
+
+func checkThresholds(limits thresholds, result ispeed.Result) []thresholdFailure {
+	var failures []thresholdFailure
+	if limits.MaxPing > 0 && result.Ping.Samples > 0 && result.Ping.Min > limits.MaxPing {
+		failures = append(failures, thresholdFailure{gatePing,
+			fmt.Sprintf("ping %.2f ms is above -max-ping %s", durationMs(result.Ping.Min), limits.MaxPing)})
+	}
+	if limits.MinDownload > 0 && result.Download.Mbps < limits.MinDownload {
+		failures = append(failures, thresholdFailure{gateDownload,
+			fmt.Sprintf("download %.2f Mbps is below -min-download %.2f", result.Download.Mbps, limits.MinDownload)})
+	}
+	if limits.MinUpload > 0 && result.Upload.Mbps < limits.MinUpload {
+		failures = append(failures, thresholdFailure{gateUpload,
+			fmt.Sprintf("upload %.2f Mbps is below -min-upload %.2f", result.Upload.Mbps, limits.MinUpload)})
+	}
+	return failures
+}
+
+// gateFailed reports whether any failure counts toward the exit status.
+func gateFailed(gate string, failures []thresholdFailure) bool {
+	for _, failure := range failures {
+		if gate == gateAll || gate == failure.Metric {
+			return true
+		}
+	}
+	return false
+}
+
+// runFailed reports whether the run exits non-zero: a phase failed, even
+// though the partial result was still written, or a gated threshold did.
+func runFailed(gate string, failures []thresholdFailure, result ispeed.Result) bool {
+	return !result.Complete() || gateFailed(gate, failures)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+func TestGates(t *testing.T) {
+	limits := thresholds{MinDownload: 100, MinUpload: 20, MaxPing: 30 * time.Millisecond}
+	good := ispeed.Result{
+		Ping:     ispeed.PingMetrics{Min: 10 * time.Millisecond, Samples: 5},
+		Download: ispeed.SpeedMetrics{Mbps: 200},
+		Upload:   ispeed.SpeedMetrics{Mbps: 50},
+	}
+	slowPing, slowDown, slowUp := good, good, good
+	slowPing.Ping.Min = 40 * time.Millisecond
+	slowDown.Download.Mbps = 50
+	slowUp.Upload.Mbps = 10
+	// Without samples there is no ping to hold against -max-ping.
+	noPing := good
+	noPing.Ping = ispeed.PingMetrics{}
+
+	for _, tt := range []struct {
+		name    string
+		result  ispeed.Result
+		metrics []string
+		// fails lists the gates that turn these failures into an exit status.
+		fails []string
+	}{
+		{"all pass", good, nil, nil},
+		{"ping", slowPing, []string{gatePing}, []string{gateAll, gatePing}},
+		{"download", slowDown, []string{gateDownload}, []string{gateAll, gateDownload}},
+		{"upload", slowUp, []string{gateUpload}, []string{gateAll, gateUpload}},
+		{"no ping samples", noPing, nil, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := checkThresholds(limits, tt.result)
+			var metrics []string
+			for _, failure := range failures {
+				metrics = append(metrics, failure.Metric)
+			}
+			if !slices.Equal(metrics, tt.metrics) {
+				t.Errorf("failed metrics %v, want %v", metrics, tt.metrics)
+			}
+			for _, gate := range []string{gateAll, gateDownload, gateUpload, gatePing} {
+				if got, want := gateFailed(gate, failures), slices.Contains(tt.fails, gate); got != want {
+					t.Errorf("gateFailed(%q) = %v, want %v", gate, got, want)
+				}
+			}
+		})
+	}
+
+	if failures := checkThresholds(thresholds{}, slowDown); len(failures) != 0 {
+		t.Errorf("zero thresholds reported %v", failures)
+	}
+}
+
+func TestValidGate(t *testing.T) {
+	for _, gate := range []string{gateAll, gateDownload, gateUpload, gatePing} {
+		if !validGate(gate) {
+			t.Errorf("validGate(%q) = false", gate)
+		}
+	}
+	for _, gate := range []string{"", "latency", "Download"} {
+		if validGate(gate) {
+			t.Errorf("validGate(%q) = true", gate)
+		}
+	}
+}
+
+func TestRunFailed(t *testing.T) {
+	failed := []thresholdFailure{{Metric: gateDownload}}
+	for _, tt := range []struct {
+		name     string
+		gate     string
+		failures []thresholdFailure
+		result   ispeed.Result
+		want     bool
+	}{
+		{"complete", gateAll, nil, ispeed.Result{}, false},
+		{"download failed", gateAll, nil, ispeed.Result{DownloadErr: errors.New("reset")}, true},
+		{"upload failed", gatePing, nil, ispeed.Result{UploadErr: errors.New("401")}, true},
+		{"gated threshold", gateDownload, failed, ispeed.Result{}, true},
+		{"threshold outside the gate", gateUpload, failed, ispeed.Result{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runFailed(tt.gate, tt.failures, tt.result); got != tt.want {
+				t.Errorf("runFailed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+const (
+	defaultRegressionWindow    = 20
+	defaultRegressionThreshold = 20.0
+	minRegressionBaseline      = 3
+)
+
+type historyEntry struct {
+	Time         time.Time `json:"time"`
+	Server       string    `json:"server"`
+	PingMs       float64   `json:"ping_ms"`
+	DownloadMbps float64   `json:"download_mbps"`
+	UploadMbps   float64   `json:"upload_mbps"`
+	Label        string    `json:"label,omitempty"`
+	Meta         *runMeta  `json:"meta,omitempty"`
+}
+
+type regressionReport struct {
+	Samples          int
+	BaselineDownload float64
+	BaselineUpload   float64
+	LatestDownload   float64
+	LatestUpload     float64
+	DownloadDropPct  float64
+	UploadDropPct    float64
+	Regressed        bool
+}
+
+func historyPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".ispeed-history.jsonl"), nil
+}
+
+func newHistoryEntry(server string, result ispeed.Result) historyEntry {
+	return historyEntry{
+		Time:         time.Now().UTC(),
+		Server:       server,
+		PingMs:       durationMs(result.Ping.Min),
+		DownloadMbps: result.Download.Mbps,
+		UploadMbps:   result.Upload.Mbps,
+		Label:        result.Label,
+		Meta:         newRunMeta(result.Meta),
+	}
+}
+
+func appendHistory(path string, entry historyEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func loadHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// Skip partially written or hand-edited lines instead of failing the whole check.
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func medianFloat(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func dropPercent(baseline float64, latest float64) float64 {
+	if baseline <= 0 {
+		return 0
+	}
+	return (baseline - latest) / baseline * 100
+}
+
+func checkRegression(entries []historyEntry, window int, threshold float64) (regressionReport, error) {
+	if window < 1 {
+		window = defaultRegressionWindow
+	}
+	if len(entries) < minRegressionBaseline+1 {
+		return regressionReport{Samples: max(len(entries)-1, 0)}, fmt.Errorf("not enough history: need at least %d runs, have %d", minRegressionBaseline+1, len(entries))
+	}
+
+	latest := entries[len(entries)-1]
+	baseline := entries[:len(entries)-1]
+	if len(baseline) > window {
+		baseline = baseline[len(baseline)-window:]
+	}
+
+	downloads := make([]float64, 0, len(baseline))
+	uploads := make([]float64, 0, len(baseline))
+	for _, entry := range baseline {
+		downloads = append(downloads, entry.DownloadMbps)
+		uploads = append(uploads, entry.UploadMbps)
+	}
+
+	report := regressionReport{
+		Samples:          len(baseline),
+		BaselineDownload: medianFloat(downloads),
+		BaselineUpload:   medianFloat(uploads),
+		LatestDownload:   latest.DownloadMbps,
+		LatestUpload:     latest.UploadMbps,
+	}
+	report.DownloadDropPct = dropPercent(report.BaselineDownload, report.LatestDownload)
+	report.UploadDropPct = dropPercent(report.BaselineUpload, report.LatestUpload)
+	report.Regressed = report.DownloadDropPct > threshold || report.UploadDropPct > threshold
+
+	return report, nil
+}
+
+func runRegression(args []string) int {
+	fs := flag.NewFlagSet("regression", flag.ExitOnError)
+	defaultPath, _ := historyPath()
+	path := fs.String("history-file", defaultPath, "history file to read")
+	window := fs.Int("window", defaultRegressionWindow, "number of previous runs in the baseline")
+	threshold := fs.Float64("threshold", defaultRegressionThreshold, "allowed drop from baseline in percent")
+	_ = fs.Parse(args)
+
+	entries, err := loadHistory(*path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Println("no history recorded yet, run ispeed with -history first")
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "read history: %v\n", err)
+		return 2
+	}
+
+	report, err := checkRegression(entries, *window, *threshold)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 0
+	}
+
+	fmt.Printf("baseline (median of %d runs): download %.2f Mbps, upload %.2f Mbps\n", report.Samples, report.BaselineDownload, report.BaselineUpload)
+	fmt.Printf("latest: download %.2f Mbps (%+.1f%%), upload %.2f Mbps (%+.1f%%)\n",
+		report.LatestDownload, -report.DownloadDropPct, report.LatestUpload, -report.UploadDropPct)
+	if report.Regressed {
+		fmt.Printf("regression: throughput dropped more than %.1f%% below baseline\n", *threshold)
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
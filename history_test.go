@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runs builds a history with one entry per download rate and an upload of a
+// tenth of it.
+func runs(downloads ...float64) []historyEntry {
+	entries := make([]historyEntry, len(downloads))
+	for i, download := range downloads {
+		entries[i] = historyEntry{DownloadMbps: download, UploadMbps: download / 10}
+	}
+	return entries
+}
+
+func TestCheckRegressionSparseHistory(t *testing.T) {
+	for n := range minRegressionBaseline + 1 {
+		report, err := checkRegression(runs(make([]float64, n)...), 20, 20)
+		if err == nil {
+			t.Errorf("%d runs: no error, want not enough history", n)
+		}
+		if report.Regressed {
+			t.Errorf("%d runs: reported a regression without a baseline", n)
+		}
+	}
+	if _, err := checkRegression(runs(100, 100, 100, 100), 20, 20); err != nil {
+		t.Errorf("%d runs: %v", minRegressionBaseline+1, err)
+	}
+}
+
+func TestCheckRegressionThreshold(t *testing.T) {
+	tests := []struct {
+		name   string
+		latest float64
+		want   bool
+	}{
+		{"steady", 100, false},
+		{"faster", 150, false},
+		{"at threshold", 80, false},
+		{"past threshold", 79, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := checkRegression(runs(100, 90, 110, 100, tt.latest), 20, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.BaselineDownload != 100 {
+				t.Errorf("baseline = %v, want the median 100", report.BaselineDownload)
+			}
+			if report.Regressed != tt.want {
+				t.Errorf("Regressed = %v with a %.1f%% drop, want %v", report.Regressed, report.DownloadDropPct, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRegressionWindow(t *testing.T) {
+	// The old fast runs fall outside a window of three, so the latest run
+	// matches its baseline.
+	entries := runs(500, 500, 500, 500, 100, 100, 100, 100)
+	report, err := checkRegression(entries, 3, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Samples != 3 || report.BaselineDownload != 100 || report.Regressed {
+		t.Errorf("report = %+v, want a baseline of the last 3 runs at 100", report)
+	}
+
+	// Without a window every earlier run counts.
+	report, err = checkRegression(entries, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Samples != len(entries)-1 || !report.Regressed {
+		t.Errorf("report = %+v, want a regression against all %d runs", report, len(entries)-1)
+	}
+}
+
+func TestMedianFloat(t *testing.T) {
+	for _, tt := range []struct {
+		values []float64
+		want   float64
+	}{
+		{nil, 0},
+		{[]float64{3}, 3},
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	} {
+		if got := medianFloat(tt.values); got != tt.want {
+			t.Errorf("medianFloat(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHistorySkipsBrokenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := appendHistory(path, historyEntry{DownloadMbps: 100}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{\"download_mbps\": 5\n\n")
+	f.Close()
+	if err := appendHistory(path, historyEntry{DownloadMbps: 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].DownloadMbps != 100 || entries[1].DownloadMbps != 200 {
+		t.Errorf("entries = %+v, want the two complete lines", entries)
+	}
+}
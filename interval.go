@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+// runInterval repeats the test every opts.Interval and writes one line per
+// run, JSON unless -csv was given, turning ispeed into a connection monitor.
+// The first SIGINT or SIGTERM lets the running test finish and then stops; a
+// second one cancels the test as well.
+func runInterval(cfg ispeed.ClientConfig, opts cliOptions) {
+	if opts.Format != formatCSV {
+		opts.Format = formatJSON
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+		<-signals
+		cancel()
+	}()
+
+	// last is the most recent run written out, which -on-change compares to.
+	var last *ispeed.Result
+	for {
+		runCfg := cfg
+		if cfg.BaseURL == "" {
+			// selectServer reuses the cached choice while it is fresh.
+			selected, err := selectServer(cfg, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "select server: %v\n", err)
+			}
+			runCfg.BaseURL = selected
+		}
+		if runCfg.BaseURL != "" {
+			result, err := ispeed.RunClientContext(ctx, runCfg)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				fmt.Fprint(os.Stderr, "speed test failed: ")
+				printError(err)
+			default:
+				show := last == nil || changedBeyond(*last, result, opts.OnChange)
+				writeIntervalResult(opts, runCfg.BaseURL, result, last == nil, show)
+				if show {
+					last = &result
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(opts.Interval):
+		}
+	}
+}
+
+// changedBeyond reports whether download, upload or ping of cur differs from
+// prev by more than pct percent. A pct of zero or less counts every run as
+// changed.
+func changedBeyond(prev, cur ispeed.Result, pct float64) bool {
+	if pct <= 0 {
+		return true
+	}
+	moved := func(before, after float64) bool {
+		if before == 0 {
+			return after != 0
+		}
+		return math.Abs(after-before)/before*100 > pct
+	}
+	return moved(prev.Download.Mbps, cur.Download.Mbps) ||
+		moved(prev.Upload.Mbps, cur.Upload.Mbps) ||
+		moved(float64(prev.Ping.Avg), float64(cur.Ping.Avg))
+}
+
+// writeIntervalResult emits one run and the side outputs that make sense per
+// run. Thresholds are left out: they exit the process. With show unset, as
+// for a run -on-change holds back, only the side outputs are written; first
+// is set until a run has been shown.
+func writeIntervalResult(opts cliOptions, server string, result ispeed.Result, first bool, show bool) {
+	warnPhaseErrors(result)
+	if show {
+		writeIntervalLine(opts, server, result, first)
+	}
+
+	if opts.PromFile != "" {
+		err := writeFileAtomic(opts.PromFile, func(w io.Writer) {
+			writePrometheus(w, server, result, time.Now())
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "write -prometheus-file: %v\n", err)
+		}
+	}
+	if opts.History && result.Complete() {
+		recordHistory(server, result)
+	}
+}
+
+func writeIntervalLine(opts cliOptions, server string, result ispeed.Result, first bool) {
+	out := os.Stdout
+	if opts.CSVFile != "" {
+		file, err := os.OpenFile(opts.CSVFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open -csv-file: %v\n", err)
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+	if opts.Format == formatCSV {
+		// A terminal or pipe gets the header once, not before every row.
+		writeCSV(out, server, result, time.Now(), needsCSVHeader(out) && (first || opts.CSVFile != ""))
+	} else {
+		writeJSON(out, result, opts.DurationUnit, opts.Decimals)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+func TestChangedBeyond(t *testing.T) {
+	result := func(download, upload float64, ping time.Duration) ispeed.Result {
+		return ispeed.Result{
+			Download: ispeed.SpeedMetrics{Mbps: download},
+			Upload:   ispeed.SpeedMetrics{Mbps: upload},
+			Ping:     ispeed.PingMetrics{Avg: ping},
+		}
+	}
+	prev := result(100, 20, 20*time.Millisecond)
+	tests := []struct {
+		name string
+		cur  ispeed.Result
+		pct  float64
+		want bool
+	}{
+		{"disabled", prev, 0, true},
+		{"same", prev, 10, false},
+		{"download within", result(95, 20, 20*time.Millisecond), 10, false},
+		{"download drop", result(80, 20, 20*time.Millisecond), 10, true},
+		{"upload rise", result(100, 25, 20*time.Millisecond), 10, true},
+		{"ping rise", result(100, 20, 30*time.Millisecond), 10, true},
+		{"ping within", result(100, 20, 21*time.Millisecond), 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedBeyond(prev, tt.cur, tt.pct); got != tt.want {
+				t.Errorf("changedBeyond = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangedBeyondFromZero(t *testing.T) {
+	// A phase that was not measured before but is now counts as a change.
+	prev := ispeed.Result{Download: ispeed.SpeedMetrics{Mbps: 100}}
+	cur := ispeed.Result{Download: ispeed.SpeedMetrics{Mbps: 100}, Upload: ispeed.SpeedMetrics{Mbps: 10}}
+	if !changedBeyond(prev, cur, 10) {
+		t.Error("changedBeyond = false, want true")
+	}
+	if changedBeyond(prev, prev, 10) {
+		t.Error("changedBeyond of unchanged zeros = true, want false")
+	}
+}
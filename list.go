@@ -0,0 +1,66 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+// listServers probes the server list the way auto-select does and prints
+// each server's median latency, fastest first, so an edited ~/.ispeed.yaml
+// can be checked without running a test.
+func listServers(w io.Writer, cfg ispeed.ClientConfig, opts cliOptions) error {
+	list, err := loadServerList(opts.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("read server list: %w", err)
+	}
+	candidates := probeServers(cfg, serversInRegion(list.Servers, opts.Region))
+	if len(candidates) == 0 {
+		return fmt.Errorf("no servers defined in config")
+	}
+	// Unreachable servers sort last, in list order.
+	slices.SortStableFunc(candidates, func(a, b serverCandidate) int {
+		switch {
+		case (a.err != nil) != (b.err != nil):
+			if a.err != nil {
+				return 1
+			}
+			return -1
+		case a.err != nil:
+			return 0
+		}
+		return cmp.Compare(a.latency, b.latency)
+	})
+
+	rows := make([][]string, 0, len(candidates))
+	for _, c := range candidates {
+		latency := "unreachable"
+		if c.err == nil {
+			latency = fmt.Sprintf("%.2f ms", durationMs(c.latency))
+		}
+		rows = append(rows, []string{c.name, c.url, latency})
+	}
+	headerStyle := lipgloss.NewStyle().Foreground(colors.label).Bold(true).Padding(0, 1)
+	cellStyle := lipgloss.NewStyle().Padding(0, 1)
+	servers := table.New().
+		Border(lipgloss.RoundedBorder()).
+		BorderStyle(lipgloss.NewStyle().Foreground(colors.border)).
+		Headers("Name", "URL", "Latency").
+		Rows(rows...).
+		StyleFunc(func(row, col int) lipgloss.Style {
+			switch {
+			case row == table.HeaderRow:
+				return headerStyle
+			case col == 2:
+				return cellStyle.Align(lipgloss.Right)
+			}
+			return cellStyle
+		})
+	fmt.Fprintln(w, servers.Render())
+	return nil
+}
@@ -1,23 +1,41 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/charmbracelet/bubbles/progress"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/charmbracelet/x/term"
 	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	rateMismatchRatio = 0.25
+	// similarLatencyRatio is how much slower than the fastest server a server
+	// may be and still be chosen for having less load.
+	similarLatencyRatio = 1.25
+)
+
 type progressMsg struct {
 	update ispeed.ProgressUpdate
 }
@@ -31,8 +49,13 @@ type errMsg struct {
 }
 
 type progressState struct {
-	percent float64
-	mbps    float64
+	bar        progress.Model
+	percent    float64
+	mbps       float64
+	warmup     bool
+	bytes      int64
+	totalBytes int64
+	eta        time.Duration
 }
 
 type serverList struct {
@@ -42,6 +65,59 @@ type serverList struct {
 type serverEntry struct {
 	Name string `yaml:"name"`
 	URL  string `yaml:"url"`
+	// Region groups servers for -region, e.g. "eu" or "us-east"; Location is
+	// a free-form description such as "Frankfurt, DE". Both are optional.
+	Region   string `yaml:"region"`
+	Location string `yaml:"location"`
+}
+
+// serversInRegion keeps the servers whose Region matches region, ignoring
+// case. An empty region, or one no server is in, keeps the whole list so a
+// typo never leaves nothing to test against.
+func serversInRegion(servers []serverEntry, region string) []serverEntry {
+	if region == "" {
+		return servers
+	}
+	var matched []serverEntry
+	for _, server := range servers {
+		if strings.EqualFold(server.Region, region) {
+			matched = append(matched, server)
+		}
+	}
+	if len(matched) == 0 {
+		log.Printf("[WARN] no server in region %q, using all servers", region)
+		return servers
+	}
+	return matched
+}
+
+type cliOptions struct {
+	History      bool
+	NoAuto       bool
+	ConfigFile   string
+	Region       string
+	ListServers  bool
+	NoCache      bool
+	CacheTTL     time.Duration
+	TUI          bool
+	Format       string
+	CSVFile      string
+	PromFile     string
+	Interval     time.Duration
+	OnChange     float64
+	DurationUnit string
+	Decimals     int
+	Pick         bool
+	Explain      bool
+	PingHist     bool
+	DumpConfig   bool
+	Serve        bool
+	Listen       string
+	LogFile      string
+	Verbose      bool
+	NoColor      bool
+	Theme        string
+	Thresholds   thresholds
 }
 
 type model struct {
@@ -54,6 +130,10 @@ type model struct {
 	upload       progressState
 	result       *ispeed.Result
 	err          error
+	picker       *serverPicker
+	start        func(ispeed.ClientConfig)
+	// cancel stops a running test when the user quits the UI.
+	cancel context.CancelFunc
 }
 
 func newModel(cfg ispeed.ClientConfig, progressCh <-chan ispeed.ProgressUpdate, progressDone <-chan struct{}) model {
@@ -62,31 +142,77 @@ func newModel(cfg ispeed.ClientConfig, progressCh <-chan ispeed.ProgressUpdate,
 		progressCh:   progressCh,
 		progressDone: progressDone,
 		width:        72,
+		ping:         progressState{bar: newPhaseBar()},
+		download:     progressState{bar: newPhaseBar()},
+		upload:       progressState{bar: newPhaseBar()},
 	}
 }
 
+// phaseBarWidth keeps the bar short enough that a line with the rate,
+// transferred bytes and ETA still fits in 80 columns.
+const phaseBarWidth = 20
+
+func newPhaseBar() progress.Model {
+	return progress.New(progress.WithGradient(colors.barFrom, colors.barTo), progress.WithColorProfile(lipgloss.ColorProfile()), progress.WithWidth(phaseBarWidth), progress.WithoutPercentage())
+}
+
 func (m model) Init() tea.Cmd {
-	return tea.Batch(listenProgress(m.progressCh), listenDone(m.progressDone))
+	cmds := []tea.Cmd{listenProgress(m.progressCh), listenDone(m.progressDone)}
+	if m.picker != nil {
+		cmds = append(cmds, m.picker.probeAll(m.cfg)...)
+	}
+	return tea.Batch(cmds...)
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if m.picker != nil {
+		return m.updatePicker(msg)
+	}
+
 	switch typed := msg.(type) {
 	case tea.WindowSizeMsg:
 		m.width = typed.Width
 		return m, nil
+	case tea.KeyMsg:
+		switch typed.String() {
+		case "q", "esc", "ctrl+c":
+			if m.cancel != nil {
+				m.cancel()
+			}
+			m.err = context.Canceled
+			return m, tea.Quit
+		}
+		return m, nil
+	case progress.FrameMsg:
+		// Each bar only animates on frames carrying its own ID.
+		var cmds [3]tea.Cmd
+		m.ping.bar, cmds[0] = updateBar(m.ping.bar, typed)
+		m.download.bar, cmds[1] = updateBar(m.download.bar, typed)
+		m.upload.bar, cmds[2] = updateBar(m.upload.bar, typed)
+		return m, tea.Batch(cmds[:]...)
 	case progressMsg:
+		var animate tea.Cmd
 		switch typed.update.Phase {
 		case "ping":
+			animate = m.ping.bar.SetPercent(typed.update.Percent / 100)
 			m.ping.percent = typed.update.Percent
 			m.ping.mbps = typed.update.PingMs
 		case "download":
+			animate = m.download.bar.SetPercent(typed.update.Percent / 100)
 			m.download.percent = typed.update.Percent
 			m.download.mbps = typed.update.Mbps
+			m.download.warmup = typed.update.Warmup
+			m.download.bytes, m.download.totalBytes = typed.update.Bytes, typed.update.TotalBytes
+			m.download.eta = typed.update.ETA
 		case "upload":
+			animate = m.upload.bar.SetPercent(typed.update.Percent / 100)
 			m.upload.percent = typed.update.Percent
 			m.upload.mbps = typed.update.Mbps
+			m.upload.warmup = typed.update.Warmup
+			m.upload.bytes, m.upload.totalBytes = typed.update.Bytes, typed.update.TotalBytes
+			m.upload.eta = typed.update.ETA
 		}
-		return m, listenProgress(m.progressCh)
+		return m, tea.Batch(listenProgress(m.progressCh), animate)
 	case resultMsg:
 		if typed.result.Ping.Min != 0 || typed.result.Download.Mbps != 0 || typed.result.Upload.Mbps != 0 {
 			m.result = &typed.result
@@ -99,20 +225,41 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+func updateBar(bar progress.Model, msg progress.FrameMsg) (progress.Model, tea.Cmd) {
+	updated, cmd := bar.Update(msg)
+	return updated.(progress.Model), cmd
+}
+
 func (m model) View() string {
-	title := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("69")).Render("ispeed")
-	subtitle := lipgloss.NewStyle().Foreground(lipgloss.Color("245")).Render(m.cfg.BaseURL)
+	title := lipgloss.NewStyle().Bold(true).Foreground(colors.title).Render("ispeed")
+	if m.picker != nil {
+		return m.picker.view(title)
+	}
+	subtitle := lipgloss.NewStyle().Foreground(colors.muted).Render(m.cfg.BaseURL)
 
+	if errors.Is(m.err, context.Canceled) {
+		cancelledStyle := lipgloss.NewStyle().Foreground(colors.muted)
+		return fmt.Sprintf("%s\n%s\n\n%s\n", title, subtitle, cancelledStyle.Render("cancelled"))
+	}
 	if m.err != nil {
-		errorStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Bold(true)
+		errorStyle := lipgloss.NewStyle().Foreground(colors.failure).Bold(true)
 		return fmt.Sprintf("%s\n%s\n\n%s\n", title, subtitle, errorStyle.Render(m.err.Error()))
 	}
 
-	content := []string{title, subtitle, ""}
-	content = append(content, renderPingLine(m.ping.percent, m.cfg.PingCount, m.ping.mbps))
-	content = append(content, renderSpeedLine("Download", m.download.mbps))
-	content = append(content, renderSpeedLine("Upload", m.upload.mbps))
+	if m.result != nil {
+		// main prints the summary once the program has exited, so the last
+		// frame only clears the progress lines.
+		return ""
+	}
 
+	content := []string{title, subtitle, ""}
+	if m.cfg.SkipPing {
+		content = append(content, renderSkippedPingLine())
+	} else {
+		content = append(content, renderPingLine(m.ping.percent, m.cfg.PingCount, m.ping.mbps)+"  "+m.ping.bar.View())
+	}
+	content = append(content, renderSpeedLine("Download", m.download.mbps)+"  "+m.download.bar.View()+renderTransferred(m.download))
+	content = append(content, renderSpeedLine("Upload", m.upload.mbps)+"  "+m.upload.bar.View()+renderTransferred(m.upload))
 	return strings.Join(content, "\n") + "\n"
 }
 
@@ -134,9 +281,9 @@ func listenDone(ch <-chan struct{}) tea.Cmd {
 }
 
 func renderPingLine(percent float64, total int, pingMs float64) string {
-	labelStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("252")).Bold(true)
-	valueStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("245"))
-	accentStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("51")).Bold(true)
+	labelStyle := lipgloss.NewStyle().Foreground(colors.label).Bold(true)
+	valueStyle := lipgloss.NewStyle().Foreground(colors.muted)
+	accentStyle := lipgloss.NewStyle().Foreground(colors.accent).Bold(true)
 	current := int(math.Round((percent / 100) * float64(total)))
 	if current < 0 {
 		current = 0
@@ -150,9 +297,105 @@ func renderPingLine(percent float64, total int, pingMs float64) string {
 	return fmt.Sprintf("%s %s  %s", labelStyle.Render("Ping"), progressText, pingText)
 }
 
+// renderTransferred shows how far a running phase has got, e.g.
+// "312 MB / 400 MB  eta 3s", and whether it is still warming up.
+func renderTransferred(state progressState) string {
+	if state.bytes == 0 {
+		return ""
+	}
+	valueStyle := lipgloss.NewStyle().Foreground(colors.muted)
+	text := "  " + formatMB(state.bytes)
+	if state.totalBytes > 0 {
+		text += " / " + formatMB(state.totalBytes)
+	}
+	if eta := state.eta.Round(time.Second); eta > 0 {
+		text += "  eta " + eta.String()
+	}
+	if state.warmup {
+		text += "  warming up"
+	}
+	return valueStyle.Render(text)
+}
+
+// formatMB uses the same 1024*1024-byte megabytes as -download-mb.
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.0f MB", float64(bytes)/(1024*1024))
+}
+
+// renderSummary is the result table printed after the interactive UI exits.
+func renderSummary(cfg ispeed.ClientConfig, result ispeed.Result) string {
+	title := lipgloss.NewStyle().Bold(true).Foreground(colors.title).Render("ispeed")
+	subtitle := lipgloss.NewStyle().Foreground(colors.muted).Render(cfg.BaseURL)
+	failed := lipgloss.NewStyle().Foreground(colors.failure).Bold(true).Render("failed")
+
+	rows := make([][]string, 0, 3)
+	switch {
+	case result.PingErr != nil:
+		rows = append(rows, []string{"Ping", failed, ""})
+	case cfg.SkipPing:
+		rows = append(rows, []string{"Ping", "n/a", ""})
+	default:
+		detail := fmt.Sprintf("avg %.2f ms  p95 %.2f ms", durationMs(result.Ping.Avg), durationMs(result.Ping.P95))
+		if result.Ping.Samples > 1 {
+			detail += fmt.Sprintf("  jitter %.2f ms", durationMs(result.Ping.Jitter))
+		}
+		rows = append(rows, []string{"Ping", fmt.Sprintf("%.2f ms", durationMs(result.Ping.Min)), detail})
+	}
+	speedRow := func(label string, metrics ispeed.SpeedMetrics, err error) []string {
+		switch {
+		case err != nil:
+			return []string{label, failed, ""}
+		case result.Aborted:
+			return []string{label, "skipped", ""}
+		}
+		detail := formatMB(metrics.Bytes)
+		if metrics.Protocol != "" {
+			detail += "  " + metrics.Protocol
+		}
+		if cfg.Bufferbloat && result.Ping.Samples > 0 {
+			detail += fmt.Sprintf("  loaded ping %.2f ms", durationMs(metrics.LoadedPing.Avg))
+		}
+		return []string{label, fmt.Sprintf("%.2f Mbps", metrics.Mbps), detail}
+	}
+	rows = append(rows, speedRow("Download", result.Download, result.DownloadErr), speedRow("Upload", result.Upload, result.UploadErr))
+	if len(result.RampProfile) > 0 {
+		rows = append(rows, []string{"Ramp", "knee " + streamsText(result.RampKnee), formatRamp(result.RampProfile)})
+	}
+
+	labelStyle := lipgloss.NewStyle().Foreground(colors.label).Bold(true).Padding(0, 1)
+	valueStyle := lipgloss.NewStyle().Foreground(colors.accent).Bold(true).Padding(0, 1).Align(lipgloss.Right)
+	detailStyle := lipgloss.NewStyle().Foreground(colors.muted).Padding(0, 1)
+	summary := table.New().
+		Border(lipgloss.RoundedBorder()).
+		BorderStyle(lipgloss.NewStyle().Foreground(colors.border)).
+		Rows(rows...).
+		StyleFunc(func(_, col int) lipgloss.Style {
+			switch col {
+			case 0:
+				return labelStyle
+			case 1:
+				return valueStyle
+			}
+			return detailStyle
+		})
+
+	content := []string{title, subtitle, summary.Render()}
+	if !result.Aborted && result.Complete() {
+		verdictStyle := lipgloss.NewStyle().Foreground(colors.verdict).Bold(true)
+		content = append(content, verdictStyle.Render(ispeed.Verdict(result)))
+	}
+	return strings.Join(content, "\n") + "\n"
+}
+
+func renderSkippedPingLine() string {
+	labelStyle := lipgloss.NewStyle().Foreground(colors.label).Bold(true)
+	valueStyle := lipgloss.NewStyle().Foreground(colors.muted)
+	return fmt.Sprintf("%s %s", labelStyle.Render("Ping"), valueStyle.Render("n/a"))
+}
+
 func renderSpeedLine(label string, mbps float64) string {
-	labelStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("252")).Bold(true)
-	valueStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("51")).Bold(true)
+	labelStyle := lipgloss.NewStyle().Foreground(colors.label).Bold(true)
+	valueStyle := lipgloss.NewStyle().Foreground(colors.accent).Bold(true)
 	return fmt.Sprintf("%-8s %s", labelStyle.Render(label), valueStyle.Render(fmt.Sprintf("%6.2f Mbps", mbps)))
 }
 
@@ -164,14 +407,23 @@ func configPath() (string, error) {
 	return filepath.Join(homeDir, ".ispeed.yaml"), nil
 }
 
-func loadServerList() (serverList, error) {
-	path, err := configPath()
-	if err != nil {
-		return serverList{}, err
+// loadServerList reads the server list from path, or from ~/.ispeed.yaml when
+// path is empty. Only the default file may be missing; an explicit path that
+// cannot be read is an error.
+func loadServerList(path string) (serverList, error) {
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = configPath(); err != nil {
+			return serverList{}, err
+		}
 	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if explicit {
+			return serverList{}, err
+		}
 		log.Printf("[ERROR] Failed to read config file at ~/.ispeed.yaml")
 		data = []byte(defaultConfig())
 	}
@@ -184,137 +436,859 @@ func loadServerList() (serverList, error) {
 	return list, nil
 }
 
-func defaultConfig() (string) {
+func defaultConfig() string {
 	return "servers:\n  - name: Default\n    url: https://speed.getanswers.pro\n"
 }
 
-func pickFastestServer() (string, error) {
-	list, err := loadServerList()
+func pickFastestServer(cfg ispeed.ClientConfig, configFile string, region string) (string, error) {
+	list, err := loadServerList(configFile)
 	if err != nil {
 		return "", fmt.Errorf("read server list: %w", err)
 	}
+	list.Servers = serversInRegion(list.Servers, region)
 
 	if len(list.Servers) == 0 {
 		return "", fmt.Errorf("no servers defined in config")
 	}
 
+	candidates := slices.DeleteFunc(probeServers(cfg, list.Servers), func(c serverCandidate) bool { return c.err != nil })
+	best, ok := chooseServer(candidates)
+	if !ok {
+		return "", fmt.Errorf("no reachable servers found")
+	}
+
+	return best.url, nil
+}
+
+// probeConcurrency is how many servers may be probed at once.
+func probeConcurrency(cfg ispeed.ClientConfig) int {
+	if cfg.MaxProbeConcurrency < 1 {
+		return ispeed.DefaultProbeConcurrency
+	}
+	return cfg.MaxProbeConcurrency
+}
+
+// probeServers pings every server in the list, at most cfg.MaxProbeConcurrency
+// at a time, and returns one candidate per server with a URL in list order.
+// A server that answered none of the samples has err set.
+func probeServers(cfg ispeed.ClientConfig, servers []serverEntry) []serverCandidate {
+	samples := cfg.ProbeSamples
+	if samples < 1 {
+		samples = ispeed.DefaultProbeSamples
+	}
+
+	servers = slices.DeleteFunc(slices.Clone(servers), func(s serverEntry) bool { return s.URL == "" })
 	client := &http.Client{Timeout: 4 * time.Second}
-	bestURL := ""
-	bestLatency := time.Duration(1<<63 - 1)
+	candidates := make([]serverCandidate, len(servers))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probeConcurrency(cfg))
 
-	for _, server := range list.Servers {
-		if server.URL == "" {
-			continue
-		}
-		start := time.Now()
-		resp, err := client.Get(strings.TrimRight(server.URL, "/") + "/ping")
-		if err != nil {
-			continue
-		}
-		_, _ = io.Copy(io.Discard, resp.Body)
-		_ = resp.Body.Close()
-		elapsed := time.Since(start)
-		if elapsed < bestLatency {
-			bestLatency = elapsed
-			bestURL = strings.TrimRight(server.URL, "/")
-		}
+	for i, server := range servers {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// The samples run back to back on one connection, so a server
+			// costs about samples round trips and the probes stay concurrent.
+			var latencies []time.Duration
+			var marked bool
+			var lastErr error
+			for range samples {
+				elapsed, ok, err := ispeed.ProbeServer(context.Background(), client, server.URL)
+				if err != nil {
+					lastErr = err
+					continue
+				}
+				latencies = append(latencies, elapsed)
+				marked = marked || ok
+			}
+			candidate := &candidates[i]
+			candidate.name = server.Name
+			candidate.url = strings.TrimRight(server.URL, "/")
+			if len(latencies) == 0 {
+				candidate.err = lastErr
+				return
+			}
+			candidate.latency = medianDuration(latencies)
+			candidate.marked = marked
+			if marked {
+				if report, err := ispeed.FetchLoad(context.Background(), client, server.URL); err == nil {
+					candidate.load = report.Load
+				}
+			} else {
+				log.Printf("[WARN] %s did not identify as an ispeed server", server.URL)
+			}
+		})
 	}
+	wg.Wait()
+	return candidates
+}
 
-	if bestURL == "" {
-		return "", fmt.Errorf("no reachable servers found")
+// medianDuration returns the middle of items, which it sorts in place.
+func medianDuration(items []time.Duration) time.Duration {
+	slices.Sort(items)
+	mid := len(items) / 2
+	if len(items)%2 == 0 {
+		return (items[mid-1] + items[mid]) / 2
 	}
+	return items[mid]
+}
 
-	return bestURL, nil
+type serverCandidate struct {
+	name    string
+	url     string
+	latency time.Duration
+	marked  bool
+	// err is why the server could not be probed; latency is unset then.
+	err error
+	// load is the 0-1 value from /load; servers that do not report it count as idle.
+	load float64
 }
 
+// chooseServer prefers servers that identify themselves, since others could
+// be a captive portal or an older deployment. Among those, any server within
+// similarLatencyRatio of the lowest latency is close enough, and the least
+// loaded of them wins.
+func chooseServer(candidates []serverCandidate) (serverCandidate, bool) {
+	if len(candidates) == 0 {
+		return serverCandidate{}, false
+	}
+	pool := candidates
+	if slices.ContainsFunc(candidates, func(c serverCandidate) bool { return c.marked }) {
+		pool = slices.DeleteFunc(slices.Clone(candidates), func(c serverCandidate) bool { return !c.marked })
+	}
+
+	fastest := slices.MinFunc(pool, func(a, b serverCandidate) int { return cmp.Compare(a.latency, b.latency) })
+	limit := time.Duration(float64(fastest.latency) * similarLatencyRatio)
+	nearby := slices.DeleteFunc(slices.Clone(pool), func(c serverCandidate) bool { return c.latency > limit })
+	return slices.MinFunc(nearby, func(a, b serverCandidate) int {
+		if c := cmp.Compare(a.load, b.load); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.latency, b.latency)
+	}), true
+}
 
 func main() {
-	f, err := os.OpenFile("/tmp/ispeed.log", os.O_CREATE | os.O_RDWR, os.ModeTemporary)
-	if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "regression" {
+		os.Exit(runRegression(os.Args[2:]))
 	}
 
-	log.SetOutput(f)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	cfg := parseFlags()
+	cfg, opts := parseFlags()
+	openLog(opts.LogFile)
+	if opts.Verbose {
+		log.SetOutput(os.Stderr)
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if opts.Serve {
+		log.SetOutput(os.Stderr)
+		fmt.Fprintf(os.Stderr, "ispeed server listening on %s\n", opts.Listen)
+		if err := ispeed.RunServer(ispeed.ServerConfig{Addr: opts.Listen}); err != nil {
+			fmt.Fprintf(os.Stderr, "serve: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.ListServers {
+		if err := listServers(os.Stdout, cfg, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "list servers: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.Interval > 0 {
+		if cfg.BaseURL == "" && opts.NoAuto {
+			fmt.Fprintln(os.Stderr, "no server given: pass -url or drop -no-auto")
+			os.Exit(2)
+		}
+		runInterval(cfg, opts)
+		return
+	}
+	// Ctrl-C cancels a running test cleanly. The TUI reads it as a key instead
+	// and cancels through the same context.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	interactive := opts.Format == formatText && opts.PromFile == "" && !opts.Verbose && (opts.TUI || term.IsTerminal(os.Stdout.Fd()))
+	picking := opts.Pick && interactive && cfg.BaseURL == ""
+	if interactive {
+		applyTheme(opts.Theme, opts.NoColor)
+	}
 
-	if cfg.BaseURL == "" {
-		selected, err := pickFastestServer()
+	if cfg.BaseURL == "" && !picking {
+		if opts.NoAuto {
+			fmt.Fprintln(os.Stderr, "no server given: pass -url or drop -no-auto")
+			os.Exit(2)
+		}
+		selected, err := selectServer(cfg, opts)
 		if err != nil {
 			log.Fatalf("[ERROR] failed to select server: %v", err)
 		}
 		cfg.BaseURL = selected
 	}
 
-	if cfg.JSON {
-		result, err := ispeed.RunClient(cfg)
+	if opts.Format != formatText {
+		result, err := ispeed.RunClientContext(ctx, cfg)
 		if err != nil {
-			log.Fatalf("[ERROR] speed test failed: %v", err)
+			exitCancelled(err)
+			log.Printf("[ERROR] speed test failed: %v", err)
+			printError(err)
+			os.Exit(1)
 		}
-		fmt.Printf("{\"ping_ms\":%.2f,\"ping_avg_ms\":%.2f,\"ping_p95_ms\":%.2f,\"download_mbps\":%.2f,\"upload_mbps\":%.2f}\n",
-			float64(result.Ping.Min.Milliseconds()), float64(result.Ping.Avg.Milliseconds()), float64(result.Ping.P95.Milliseconds()), result.Download.Mbps, result.Upload.Mbps)
+		out := os.Stdout
+		if opts.CSVFile != "" {
+			file, err := os.OpenFile(opts.CSVFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "open -csv-file: %v\n", err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			out = file
+		}
+		writeResult(out, opts, cfg.BaseURL, result)
+		finishRun(cfg, opts, result)
 		return
 	}
 
-	progressCh := make(chan ispeed.ProgressUpdate, 16)
-	progressDone := make(chan struct{})
-	sendProgress := func(update ispeed.ProgressUpdate) {
-		select {
-		case progressCh <- update:
-		default:
+	if !interactive {
+		result, err := runPlain(ctx, cfg)
+		if err != nil {
+			exitCancelled(err)
+			printError(err)
+			os.Exit(1)
 		}
+		finishRun(cfg, opts, result)
+		return
 	}
-	cfg.Progress = func(update ispeed.ProgressUpdate) {
-		sendProgress(update)
+
+	progressCh := make(chan ispeed.ProgressUpdate, 16)
+	progressDone := make(chan struct{})
+	uiDone := make(chan struct{})
+	cfg.Progress = forwardProgress(progressCh, uiDone)
+
+	var program *tea.Program
+	startTest := func(cfg ispeed.ClientConfig) {
+		go func() {
+			result, err := ispeed.RunClientContext(ctx, cfg)
+			if err != nil {
+				program.Send(errMsg{err: err})
+				close(progressDone)
+				return
+			}
+			program.Send(resultMsg{result: result})
+			close(progressDone)
+		}()
 	}
 
 	m := newModel(cfg, progressCh, progressDone)
-	program := tea.NewProgram(m)
-
-	go func() {
-		result, err := ispeed.RunClient(cfg)
+	m.cancel = cancel
+	if picking {
+		list, err := loadServerList(opts.ConfigFile)
 		if err != nil {
-			program.Send(errMsg{err: err})
-			close(progressDone)
-			return
+			log.Fatalf("[ERROR] failed to read server list: %v", err)
 		}
-		program.Send(resultMsg{result: result})
-		close(progressDone)
-	}()
+		m.picker = newServerPicker(serversInRegion(list.Servers, opts.Region))
+		m.start = startTest
+	}
+	program = tea.NewProgram(m)
+	if !picking {
+		startTest(cfg)
+	}
 
 	finalModel, err := program.Run()
 	if err != nil {
 		log.Fatalf("[ERROR] ui failed: %v", err)
 	}
-	close(progressCh)
+	close(uiDone)
 	fmt.Print("\r\033[2K\n")
 	if finished, ok := finalModel.(model); ok {
 		if finished.err != nil {
-			fmt.Fprintln(os.Stderr, finished.err.Error())
+			exitCancelled(finished.err)
+			printError(finished.err)
 			os.Exit(1)
 		}
+		if finished.result != nil {
+			fmt.Print(renderSummary(finished.cfg, *finished.result))
+			finishRun(finished.cfg, opts, *finished.result)
+		}
+	}
+}
+
+// openLog sends the log to path, appending to earlier runs. A log that cannot
+// be opened is not worth failing the test over, so it is discarded with one
+// warning instead; an empty path discards it silently.
+func openLog(path string) {
+	log.SetOutput(io.Discard)
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: logging disabled: %v\n", err)
+		return
+	}
+	log.SetOutput(f)
+}
+
+// exitCancelled ends the process with the conventional Ctrl-C status when a
+// test stopped because it was cancelled.
+func exitCancelled(err error) {
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "cancelled")
+		os.Exit(130)
+	}
+}
+
+// forwardProgress passes updates on to the UI. Periodic updates are dropped
+// when the UI falls behind, but the closing update of a phase must reach it,
+// so that one waits for room unless the UI has already exited.
+func forwardProgress(ch chan<- ispeed.ProgressUpdate, uiDone <-chan struct{}) func(ispeed.ProgressUpdate) {
+	return func(update ispeed.ProgressUpdate) {
+		if update.Final {
+			select {
+			case ch <- update:
+			case <-uiDone:
+			}
+			return
+		}
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
+
+// finishRun handles what every output mode does once a result is in: warn,
+// record history, and turn an aborted run or a failed threshold into a failing
+// exit status.
+func finishRun(cfg ispeed.ClientConfig, opts cliOptions, result ispeed.Result) {
+	if result.Aborted {
+		fmt.Fprintf(os.Stderr, "aborted: average ping %.2f ms is over %s, skipped download and upload\n", durationMs(result.Ping.Avg), cfg.MaxStartupPing)
+		os.Exit(1)
+	}
+
+	warnPhaseErrors(result)
+	warnRateMismatch(result)
+	warnHostMismatch(cfg.BaseURL, result)
+	warnUnmarkedServer(cfg.BaseURL, result)
+	if result.Upload.Rejected > 0 {
+		fmt.Fprintf(os.Stderr, "warning: the server rejected %d upload requests; the upload result includes bytes it did not accept\n", result.Upload.Rejected)
+	}
+	// Keep machine-readable output on stdout parseable.
+	out := os.Stdout
+	if opts.Format != formatText {
+		out = os.Stderr
+	}
+	if opts.PingHist {
+		writePingHistogram(out, result.Ping.All)
+	}
+	if opts.Explain {
+		writeExplanation(out, result)
+	}
+	if opts.DumpConfig {
+		writeConfig(out, result.Config)
+	}
+	if opts.PromFile != "" {
+		err := writeFileAtomic(opts.PromFile, func(w io.Writer) {
+			writePrometheus(w, cfg.BaseURL, result, time.Now())
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "write -prometheus-file: %v\n", err)
+		}
+	}
+	// A partial result would drag down the regression baseline.
+	if opts.History && result.Complete() {
+		recordHistory(cfg.BaseURL, result)
+	}
+
+	failures := checkThresholds(opts.Thresholds, result)
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "threshold: %s\n", failure.Message)
+	}
+	if runFailed(opts.Thresholds.Gate, failures, result) {
+		os.Exit(1)
+	}
+}
+
+// warnRateMismatch flags downloads where the server sent noticeably faster or
+// slower than the client received, which points at a buffering proxy.
+func warnRateMismatch(result ispeed.Result) {
+	sent := result.Download.ServerReportedMbps
+	received := result.Download.StreamSumMbps
+	if sent <= 0 || received <= 0 {
+		return
+	}
+	if math.Abs(sent-received)/received > rateMismatchRatio {
+		fmt.Fprintf(os.Stderr, "warning: server reported sending %.2f Mbps but %.2f Mbps was received; a proxy or buffer may be skewing the download\n", sent, received)
+	}
+}
+
+// warnHostMismatch flags downloads that were redirected, e.g. to a CDN edge,
+// since the ping was then measured against a different host.
+func warnHostMismatch(baseURL string, result ispeed.Result) {
+	base, err := url.Parse(baseURL)
+	if err != nil || result.DownloadHost == "" || result.DownloadHost == base.Host {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "warning: download was served by %s but ping measured %s\n", result.DownloadHost, base.Host)
+}
+
+// warnUnmarkedServer flags a run whose server did not identify as ispeed,
+// such as a captive portal that answers every path.
+func warnUnmarkedServer(baseURL string, result ispeed.Result) {
+	if result.Ping.Unmarked {
+		fmt.Fprintf(os.Stderr, "warning: %s did not answer as an ispeed server (no %s header); the results may not measure it\n", baseURL, ispeed.MarkerHeader)
+	}
+}
+
+// warnPhaseErrors reports the phases that failed while the rest of the run
+// went on.
+func warnPhaseErrors(result ispeed.Result) {
+	for _, phase := range []struct {
+		name string
+		err  error
+	}{{"ping", result.PingErr}, {"stream ramp", result.RampErr}, {"download", result.DownloadErr}, {"upload", result.UploadErr}} {
+		if phase.err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s failed: %v\n", phase.name, phase.err)
+			if hint := errorHint(phase.err); hint != "" {
+				fmt.Fprintf(os.Stderr, "  hint: %s\n", hint)
+			}
+		}
+	}
+}
+
+// printError reports a failed run on stderr with a hint at the likely cause.
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	if hint := errorHint(err); hint != "" {
+		fmt.Fprintf(os.Stderr, "hint: %s\n", hint)
+	}
+}
+
+// errorHint turns the common ways a test fails into something to check, or
+// returns "" when the error speaks for itself.
+func errorHint(err error) string {
+	var connErr *ispeed.ConnError
+	var statusErr *ispeed.StatusError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ""
+	case errors.As(err, &connErr):
+		return "server unreachable, check -url and the network (or -proxy)"
+	case errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound:
+		return "the server has no such endpoint, check that -url points at an ispeed server"
+	case errors.As(err, &statusErr) && statusErr.Code == http.StatusRequestEntityTooLarge:
+		return "the server refused the upload size, try -upload-mb or -partial-ok"
+	case errors.As(err, &statusErr) && (statusErr.Code == http.StatusUnauthorized || statusErr.Code == http.StatusForbidden):
+		return "the server requires access this client does not have"
+	case errors.Is(err, ispeed.ErrUnsupported):
+		return "the server says it does not offer this, so the phase was skipped"
+	case errors.Is(err, ispeed.ErrNoData):
+		return "the server answered but sent no data"
+	}
+	return ""
+}
+
+// runPlain prints progress as plain lines for non-interactive stdout, where the
+// TUI would only leave escape sequences behind.
+func runPlain(ctx context.Context, cfg ispeed.ClientConfig) (ispeed.Result, error) {
+	fmt.Printf("ispeed %s\n", cfg.BaseURL)
+
+	lastPhase := ""
+	lastStep := -1
+	cfg.Progress = func(update ispeed.ProgressUpdate) {
+		step := int(update.Percent) / 25
+		if update.Phase == lastPhase && step == lastStep {
+			return
+		}
+		lastPhase, lastStep = update.Phase, step
+		if update.Phase == "ping" {
+			fmt.Printf("%-8s %3.0f%%  %6.2f ms\n", update.Phase, update.Percent, update.PingMs)
+			return
+		}
+		if update.Warmup {
+			fmt.Printf("%-8s %3.0f%%  %6.2f Mbps (warmup)\n", update.Phase, update.Percent, update.Mbps)
+			return
+		}
+		fmt.Printf("%-8s %3.0f%%  %6.2f Mbps\n", update.Phase, update.Percent, update.Mbps)
+	}
+
+	result, err := ispeed.RunClientContext(ctx, cfg)
+	if err != nil {
+		return ispeed.Result{}, err
 	}
+
+	fmt.Printf("Ping     %9s\n", pingText(result.Ping, result.Ping.Min))
+	if result.Ping.Samples > 1 {
+		fmt.Printf("Jitter   %9s\n", pingText(result.Ping, result.Ping.Jitter))
+	}
+	if cfg.SmallTransferProbe {
+		fmt.Printf("Small transfer penalty %6.2f ms\n", durationMs(result.SmallTransferPenalty))
+	}
+	if len(result.RampProfile) > 0 {
+		fmt.Printf("Ramp     knee at %s (%s)\n", streamsText(result.RampKnee), formatRamp(result.RampProfile))
+	}
+	if result.DownloadErr != nil {
+		fmt.Println("Download   failed")
+	} else {
+		fmt.Printf("Download %6.2f Mbps (%s)\n", result.Download.Mbps, result.Download.Protocol)
+	}
+	if result.Download.LoadedPing.Avg > 0 {
+		fmt.Printf("Download loaded ping %6.2f ms (%+.2f ms vs idle)\n", durationMs(result.Download.LoadedPing.Avg), durationMs(result.Download.LoadedPingDelta))
+	}
+	if result.Upload.LoadedPing.Avg > 0 {
+		fmt.Printf("Upload loaded ping %6.2f ms (%+.2f ms vs idle)\n", durationMs(result.Upload.LoadedPing.Avg), durationMs(result.Upload.LoadedPingDelta))
+	}
+	if result.UploadErr != nil {
+		fmt.Println("Upload     failed")
+	} else if result.Upload.StaticPayload {
+		fmt.Printf("Upload   %6.2f Mbps (static payload)\n", result.Upload.Mbps)
+	} else {
+		fmt.Printf("Upload   %6.2f Mbps\n", result.Upload.Mbps)
+	}
+	if cfg.Trace {
+		fmt.Printf("Connections (reused/new): ping %d/%d, download %d/%d, upload %d/%d\n",
+			result.Ping.Conns.Reused, result.Ping.Conns.New,
+			result.Download.Conns.Reused, result.Download.Conns.New,
+			result.Upload.Conns.Reused, result.Upload.Conns.New)
+	}
+	if cfg.EchoUpload {
+		fmt.Printf("Echo     %6.2f Mbps (slower of the two directions)\n", result.Upload.EchoMbps)
+	}
+	if !result.Aborted && result.Complete() {
+		fmt.Printf("Verdict  %s\n", ispeed.Verdict(result))
+	}
+	return result, nil
 }
 
-func parseFlags() ispeed.ClientConfig {
+func recordHistory(server string, result ispeed.Result) {
+	path, err := historyPath()
+	if err != nil {
+		log.Printf("[ERROR] Failed to resolve history path: %v", err)
+		return
+	}
+	if err := appendHistory(path, newHistoryEntry(server, result)); err != nil {
+		log.Printf("[ERROR] Failed to append history: %v", err)
+	}
+}
+
+func parseFlags() (ispeed.ClientConfig, cliOptions) {
 	baseURL := flag.String("url", "", "base URL for server (leave empty for auto-select)")
 	duration := flag.Duration("duration", ispeed.DefaultDuration, "test duration")
+	minDuration := flag.Duration("min-duration", 0, "with -max-duration, run each phase at least this long")
+	maxDuration := flag.Duration("max-duration", 0, "stop each phase once its rate settles, at the latest after this (0 disables)")
+	stableCV := flag.Float64("stable-cv", ispeed.DefaultStableCV, "with -max-duration, rate variation (stddev/mean) that counts as settled")
 	streams := flag.Int("streams", ispeed.DefaultStreams, "parallel streams")
+	downloadStreams := flag.Int("download-streams", 0, "parallel download streams (0 uses -streams)")
+	uploadStreams := flag.Int("upload-streams", 0, "parallel upload streams (0 uses -streams)")
 	chunkSize := flag.Int("chunk-size", ispeed.DefaultChunkSize, "chunk size in bytes")
 	downloadMB := flag.Int("download-mb", ispeed.DefaultDownloadMB, "download size per stream in MB")
+	totalDownloadMB := flag.Int("total-download-mb", 0, "download size in MB split across all streams (excludes -download-mb)")
+	sizeJitter := flag.Float64("size-jitter", 0, "vary each download request size randomly by up to this percentage")
+	noPing := flag.Bool("no-ping", false, "skip the ping phase and only measure throughput")
 	pingCount := flag.Int("ping-count", ispeed.DefaultPingCount, "number of ping samples")
+	warmup := flag.Duration("warmup", ispeed.DefaultWarmup, "leave this much of the start of download and upload out of the rate (0 disables)")
+	ipVersion := flag.String("ip", ispeed.IPVersionAuto, "address family to test over: auto, 4 or 6")
+	pingMode := flag.String("ping-mode", ispeed.PingModeHTTP, "how to ping: http, or websocket for echoes over one connection (Go server only)")
+	pingInterval := flag.Duration("ping-interval", ispeed.DefaultPingInterval, "pause between ping samples (0 sends them back to back)")
+	pingRetries := flag.Int("ping-retries", ispeed.DefaultPingRetries, "retries for a failed ping sample before the run fails (0 disables)")
+	uploadMB := flag.Int("upload-mb", 0, "upload exactly this many MB per stream instead of running for -duration (0 uses duration)")
+	requests := flag.Int("requests", 0, "fixed number of download/upload requests per phase (0 uses duration/size)")
+	downloadMode := flag.String("download-mode", ispeed.DownloadModeSize, "end the download after -download-mb per stream (size) or after -duration (duration)")
+	downloadMethod := flag.String("download-method", "GET", "HTTP method used to start a download (GET or POST)")
+	downloadBody := flag.String("download-body", "", "POST body for -download-method POST; {size} is replaced by the byte count")
 	timeout := flag.Duration("timeout", ispeed.DefaultTimeout, "request timeout")
-	jsonOut := flag.Bool("json", false, "print JSON output")
+	maxProbes := flag.Int("max-probes", ispeed.DefaultProbeConcurrency, "maximum servers probed at once during auto-select and -pick")
+	probeSamples := flag.Int("probe-samples", ispeed.DefaultProbeSamples, "pings per server during auto-select; the median decides")
+	serverRate := flag.Bool("server-rate", false, "ask the server for its sending rate and warn if it differs from the received rate")
+	uploadFile := flag.String("upload-file", "", "file to send as the upload body, looped for the duration; - reads stdin")
+	rampStreams := flag.Bool("ramp-streams", false, "before the download, find where more streams stop helping with short bursts at 1, 2, 4 and 8 streams")
+	smallProbe := flag.Bool("small-transfer-probe", false, "experimental: time a few tiny downloads to spot MTU or fragmentation issues")
+	partialOK := flag.Bool("partial-ok", false, "warn instead of failing when the server rejects an upload request")
+	seed := flag.Int64("seed", 0, "seed for a repeatable upload payload (0 uses crypto random data)")
+	forceHTTP1 := flag.Bool("http1", false, "disable HTTP/2 to compare HTTP/1.1 throughput")
+	simpleCopy := flag.Bool("simple-copy", false, "read downloads with a plain io.Copy instead of the chunk-size read loop")
+	echoUpload := flag.Bool("echo", false, "read the upload back from a server running in echo mode to test full duplex")
+	bufferbloat := flag.Bool("bufferbloat", false, "measure latency under load during the download and upload")
+	staticUpload := flag.Bool("static-upload", false, "upload one repeated buffer instead of random data (cheaper on slow CPUs)")
+	maxStartupPing := flag.Duration("abort-if-ping-over", 0, "skip download and upload when the average ping is above this (0 disables)")
+	proxy := flag.String("proxy", "", "route the test through this proxy (http://, https:// or socks5://host:port)")
+	caFile := flag.String("cacert", "", "PEM file with CA certificates to trust for the server")
+	jsonOut := flag.Bool("json", false, "print JSON output (same as -format json)")
+	format := flag.String("format", formatText, "output format: text, json, md or csv")
+	csvOut := flag.Bool("csv", false, "print one CSV row (same as -format csv)")
+	promFile := flag.String("prometheus-file", "", "write the result to this file in Prometheus text format, e.g. for the node_exporter textfile collector")
+	interval := flag.Duration("interval", 0, "repeat the test at this interval, one JSON or CSV line per run, until interrupted")
+	onChange := flag.Float64("on-change", 0, "with -interval, only write a run whose download, upload or ping moved more than this percentage from the last one written")
+	csvFile := flag.String("csv-file", "", "append the CSV row to this file instead of stdout (implies -csv)")
+	durationUnit := flag.String("duration-unit", "ms", "unit for JSON durations: ms, us or ns")
+	decimals := flag.Int("decimals", 2, "decimal places for JSON numbers")
+	label := flag.String("label", "", "tag stored with the result, e.g. \"before VPN\"")
+	clockFirstByte := flag.Bool("clock-from-first-byte", false, "start timing the download at the first response byte, excluding connection setup")
+	trace := flag.Bool("trace", false, "report how many connections each phase reused or opened")
+	tcpInfo := flag.Bool("tcp-info", false, "read kernel TCP_INFO (retransmits, RTT) from the test connections; Linux only")
+	throughputSamples := flag.Bool("throughput-samples", false, "record download and upload throughput every 200ms (JSON download_samples and upload_samples)")
+	connTrace := flag.Bool("conn-trace", false, "break the first ping down into DNS, connect, TLS and time to first byte (JSON ping_timing)")
+	strict := flag.Bool("strict", false, "require every test parameter to be given explicitly instead of falling back to defaults")
+	noMeta := flag.Bool("no-meta", false, "leave OS, architecture, hostname and version out of JSON and history output")
+	history := flag.Bool("history", false, "append the result to ~/.ispeed-history.jsonl")
+	pingHist := flag.Bool("ping-histogram", false, "after the result, print a histogram of the ping samples")
+	dumpConfig := flag.Bool("dump-config", false, "after the result, print the effective configuration as JSON")
+	explain := flag.Bool("explain", false, "after the result, describe how each number was measured")
+	minDownload := flag.Float64("min-download", 0, "exit 1 when download Mbps is below this (0 disables)")
+	minUpload := flag.Float64("min-upload", 0, "exit 1 when upload Mbps is below this (0 disables)")
+	maxPing := flag.Duration("max-ping", 0, "exit 1 when ping is above this (0 disables)")
+	gate := flag.String("gate", gateAll, "metric whose threshold sets the exit status: all, download, upload or ping")
+	pick := flag.Bool("pick", false, "choose the server from a list in the interactive UI instead of auto-selecting")
+	noColor := flag.Bool("no-color", false, "draw the interactive UI without colors or styling (also set by NO_COLOR)")
+	theme := flag.String("theme", themeAuto, "interactive UI colors: auto, dark or light")
+	tui := flag.Bool("tui", false, "use the interactive UI even when stdout is not a terminal")
+	serve := flag.Bool("serve", false, "run the reference server instead of a test")
+	listen := flag.String("listen", ispeed.DefaultServerAddr, "address for -serve to listen on")
+	configFile := flag.String("config", "", "server list file (default ~/.ispeed.yaml)")
+	noAuto := flag.Bool("no-auto", false, "fail instead of auto-selecting a server when -url is empty")
+	region := flag.String("region", "", "auto-select only among servers with this region in the server list")
+	listServersFlag := flag.Bool("list-servers", false, "ping every server in the server list, print their latencies and exit")
+	noCache := flag.Bool("no-cache", false, "ignore the cached server and run full selection")
+	verbose := flag.Bool("verbose", false, "log to stderr, including every request's URL, status, duration and bytes")
+	logFile := flag.String("log-file", filepath.Join(os.TempDir(), "ispeed.log"), "append the log to this file (empty discards it)")
+	cacheTTL := flag.Duration("cache-ttl", defaultServerCacheTTL, "how long an auto-selected server is reused (0 disables the cache)")
+	flag.Usage = usage
 	flag.Parse()
+	if err := applyEnvFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid environment: %v\n", err)
+		os.Exit(2)
+	}
+
+	if *jsonOut {
+		*format = formatJSON
+	}
+	if *csvOut || *csvFile != "" {
+		*format = formatCSV
+	}
+	if !validFormat(*format) {
+		fmt.Fprintf(os.Stderr, "unknown -format %q: use text, json, md or csv\n", *format)
+		os.Exit(2)
+	}
+	if *maxDuration > 0 && *minDuration > *maxDuration {
+		fmt.Fprintln(os.Stderr, "-min-duration cannot be longer than -max-duration")
+		os.Exit(2)
+	}
+	if *probeSamples < 1 {
+		fmt.Fprintln(os.Stderr, "-probe-samples must be at least 1")
+		os.Exit(2)
+	}
+	if !validTheme(*theme) {
+		fmt.Fprintf(os.Stderr, "unknown -theme %q: use auto, dark or light\n", *theme)
+		os.Exit(2)
+	}
+	if !validGate(*gate) {
+		fmt.Fprintf(os.Stderr, "unknown -gate %q: use all, download, upload or ping\n", *gate)
+		os.Exit(2)
+	}
+	if *ipVersion != ispeed.IPVersionAuto && *ipVersion != ispeed.IPVersion4 && *ipVersion != ispeed.IPVersion6 {
+		fmt.Fprintf(os.Stderr, "unknown -ip %q: use auto, 4 or 6\n", *ipVersion)
+		os.Exit(2)
+	}
+	if *pingMode != ispeed.PingModeHTTP && *pingMode != ispeed.PingModeWebSocket {
+		fmt.Fprintf(os.Stderr, "unknown -ping-mode %q: use http or websocket\n", *pingMode)
+		os.Exit(2)
+	}
+	if *downloadMode != ispeed.DownloadModeSize && *downloadMode != ispeed.DownloadModeDuration {
+		fmt.Fprintf(os.Stderr, "unknown -download-mode %q: use size or duration\n", *downloadMode)
+		os.Exit(2)
+	}
+	if *interval > 0 && *format == formatMarkdown {
+		fmt.Fprintln(os.Stderr, "-interval writes one line per run: use -json or -csv, not -format md")
+		os.Exit(2)
+	}
+	if *onChange < 0 {
+		fmt.Fprintln(os.Stderr, "-on-change must not be negative")
+		os.Exit(2)
+	}
+	if *onChange > 0 && *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-on-change only applies with -interval")
+		os.Exit(2)
+	}
+	if !validDurationUnit(*durationUnit) {
+		fmt.Fprintf(os.Stderr, "unknown -duration-unit %q: use ms, us or ns\n", *durationUnit)
+		os.Exit(2)
+	}
+
+	if *strict {
+		if missing := missingStrictFlags(); len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "-strict needs these flags set explicitly: %s\n", strings.Join(missing, ", "))
+			os.Exit(2)
+		}
+	}
+
+	var uploadData []byte
+	if *uploadFile != "" {
+		data, err := readUploadFile(*uploadFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read -upload-file: %v\n", err)
+			os.Exit(2)
+		}
+		uploadData = data
+	}
+
+	// The library reads 0 as "use the default", so disabling takes a negative.
+	if *pingRetries == 0 {
+		*pingRetries = -1
+	}
+	if *warmup == 0 {
+		*warmup = -1
+	}
+
+	if *totalDownloadMB > 0 {
+		if flagSet("download-mb") {
+			fmt.Fprintln(os.Stderr, "-download-mb and -total-download-mb cannot be used together")
+			os.Exit(2)
+		}
+		*downloadMB = 0
+	}
 
 	return ispeed.ClientConfig{
-		BaseURL:    strings.TrimRight(*baseURL, "/"),
-		Duration:   *duration,
-		Streams:    *streams,
-		ChunkSize:  *chunkSize,
-		DownloadMB: *downloadMB,
-		PingCount:  *pingCount,
-		Timeout:    *timeout,
-		JSON:       *jsonOut,
+		BaseURL:             strings.TrimRight(*baseURL, "/"),
+		Duration:            *duration,
+		Streams:             *streams,
+		DownloadStreams:     *downloadStreams,
+		UploadStreams:       *uploadStreams,
+		ChunkSize:           *chunkSize,
+		DownloadMB:          *downloadMB,
+		TotalDownloadMB:     *totalDownloadMB,
+		PingCount:           *pingCount,
+		PingInterval:        *pingInterval,
+		PingMode:            *pingMode,
+		IPVersion:           *ipVersion,
+		WarmupDuration:      *warmup,
+		PingRetries:         *pingRetries,
+		SkipPing:            *noPing,
+		SizeJitterPct:       *sizeJitter,
+		RequestCount:        *requests,
+		MinDuration:         *minDuration,
+		MaxDuration:         *maxDuration,
+		StableCV:            *stableCV,
+		UploadMB:            *uploadMB,
+		DownloadMode:        *downloadMode,
+		DownloadMethod:      *downloadMethod,
+		DownloadBody:        *downloadBody,
+		Timeout:             *timeout,
+		CAFile:              *caFile,
+		ProxyURL:            *proxy,
+		MaxStartupPing:      *maxStartupPing,
+		Label:               *label,
+		OmitMeta:            *noMeta,
+		Strict:              *strict,
+		Trace:               *trace,
+		ConnTrace:           *connTrace,
+		CollectSamples:      *throughputSamples,
+		TCPInfo:             *tcpInfo,
+		ClockFromFirstByte:  *clockFirstByte,
+		MaxProbeConcurrency: *maxProbes,
+		ProbeSamples:        *probeSamples,
+		StaticUpload:        *staticUpload,
+		Bufferbloat:         *bufferbloat,
+		EchoUpload:          *echoUpload,
+		SimpleCopy:          *simpleCopy,
+		ForceHTTP1:          *forceHTTP1,
+		Seed:                *seed,
+		PartialOK:           *partialOK,
+		SmallTransferProbe:  *smallProbe,
+		RampStreams:         *rampStreams,
+		UploadData:          uploadData,
+		ServerRate:          *serverRate,
+		JSON:                *format == formatJSON,
+	}, cliOptions{
+		History:      *history,
+		NoAuto:       *noAuto,
+		ConfigFile:   *configFile,
+		Region:       *region,
+		ListServers:  *listServersFlag,
+		NoCache:      *noCache,
+		CacheTTL:     *cacheTTL,
+		TUI:          *tui,
+		Format:       *format,
+		CSVFile:      *csvFile,
+		PromFile:     *promFile,
+		Interval:     *interval,
+		OnChange:     *onChange,
+		DurationUnit: *durationUnit,
+		Decimals:     max(*decimals, 0),
+		Pick:         *pick,
+		Explain:      *explain,
+		PingHist:     *pingHist,
+		DumpConfig:   *dumpConfig,
+		Serve:        *serve,
+		Listen:       *listen,
+		LogFile:      *logFile,
+		Verbose:      *verbose,
+		NoColor:      *noColor,
+		Theme:        *theme,
+		Thresholds: thresholds{
+			MinDownload: *minDownload,
+			MinUpload:   *minUpload,
+			MaxPing:     *maxPing,
+			Gate:        *gate,
+		},
 	}
 }
+
+// strictFlags are the test parameters that otherwise fall back to defaults.
+// -download-mb and -total-download-mb are alternatives, so either one counts.
+var strictFlags = [][]string{
+	{"url"},
+	{"duration"},
+	{"streams"},
+	{"chunk-size"},
+	{"download-mb", "total-download-mb"},
+	{"ping-count"},
+	{"ping-interval"},
+	{"ping-retries"},
+	{"warmup"},
+	{"timeout"},
+	{"download-method"},
+}
+
+func missingStrictFlags() []string {
+	var missing []string
+	for _, names := range strictFlags {
+		if !slices.ContainsFunc(names, flagSet) {
+			missing = append(missing, "-"+strings.Join(names, " or -"))
+		}
+	}
+	return missing
+}
+
+// readUploadFile loads the whole payload up front so it can be replayed across
+// streams; stdin may be a pipe of unknown length.
+func readUploadFile(path string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if path == "-" {
+			path = "stdin"
+		}
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return data, nil
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+// inFlightServer answers every request after a short delay and records the
+// most requests it ever had in flight at once.
+type inFlightServer struct {
+	*httptest.Server
+	current int64
+	peak    int64
+}
+
+func newInFlightServer(t *testing.T) *inFlightServer {
+	t.Helper()
+	s := &inFlightServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt64(&s.current, 1)
+		defer atomic.AddInt64(&s.current, -1)
+		for {
+			peak := atomic.LoadInt64(&s.peak)
+			if now <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestProbeServersConcurrencyCap(t *testing.T) {
+	server := newInFlightServer(t)
+	servers := make([]serverEntry, 12)
+	for i := range servers {
+		servers[i] = serverEntry{Name: "s", URL: server.URL}
+	}
+
+	cfg := ispeed.ClientConfig{MaxProbeConcurrency: 3, ProbeSamples: 1}
+	candidates := probeServers(cfg, servers)
+	if len(candidates) != len(servers) {
+		t.Fatalf("got %d candidates, want %d", len(candidates), len(servers))
+	}
+	if peak := atomic.LoadInt64(&server.peak); peak > 3 {
+		t.Errorf("%d probes in flight at once, want at most 3", peak)
+	}
+}
+
+func TestForwardProgressKeepsFinal(t *testing.T) {
+	ch := make(chan ispeed.ProgressUpdate, 1)
+	forward := forwardProgress(ch, make(chan struct{}))
+
+	// The UI is busy: periodic updates beyond the buffer are dropped, but the
+	// Final one waits for it.
+	for range 10 {
+		forward(ispeed.ProgressUpdate{Phase: "download", Percent: 50})
+	}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		forward(ispeed.ProgressUpdate{Phase: "download", Percent: 100, Final: true})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if update := <-ch; update.Final {
+		t.Fatal("the Final update overtook the buffered one")
+	}
+	select {
+	case update := <-ch:
+		if !update.Final {
+			t.Errorf("got %+v, want the Final update", update)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the Final update was dropped")
+	}
+	<-sent
+}
+
+func TestForwardProgressAfterUIExit(t *testing.T) {
+	uiDone := make(chan struct{})
+	close(uiDone)
+	forward := forwardProgress(make(chan ispeed.ProgressUpdate), uiDone)
+
+	// With nobody reading, the Final update must not block the test forever.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forward(ispeed.ProgressUpdate{Final: true})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Final update blocked after the UI exited")
+	}
+}
+
+func TestReadUploadFileStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdin
+	t.Cleanup(func() { os.Stdin = saved })
+	os.Stdin = r
+
+	// A pipe of unknown length, written in pieces while it is read.
+	want := bytes.Repeat([]byte("ispeed payload "), 10_000)
+	go func() {
+		for chunk := range slices.Chunk(want, 4096) {
+			_, _ = w.Write(chunk)
+		}
+		w.Close()
+	}()
+	got, err := readUploadFile("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes from stdin, want the %d piped", len(got), len(want))
+	}
+}
+
+func TestReadUploadFileEmptyStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	saved := os.Stdin
+	t.Cleanup(func() { os.Stdin = saved })
+	os.Stdin = r
+
+	if _, err := readUploadFile("-"); err == nil || !strings.Contains(err.Error(), "stdin is empty") {
+		t.Errorf("err = %v, want stdin is empty", err)
+	}
+}
+
+func TestChooseServerLoad(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		name       string
+		candidates []serverCandidate
+		want       string
+	}{
+		{"idle beats loaded at similar latency", []serverCandidate{
+			{name: "loaded", latency: 10 * ms, marked: true, load: 0.9},
+			{name: "idle", latency: 12 * ms, marked: true, load: 0.1},
+		}, "idle"},
+		{"load ignored when much slower", []serverCandidate{
+			{name: "loaded", latency: 10 * ms, marked: true, load: 0.9},
+			{name: "far", latency: 40 * ms, marked: true},
+		}, "loaded"},
+		{"equal load falls back to latency", []serverCandidate{
+			{name: "slower", latency: 12 * ms, marked: true, load: 0.5},
+			{name: "faster", latency: 10 * ms, marked: true, load: 0.5},
+		}, "faster"},
+		{"marked beats idle unmarked", []serverCandidate{
+			{name: "unmarked", latency: 5 * ms},
+			{name: "marked", latency: 10 * ms, marked: true, load: 0.9},
+		}, "marked"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := chooseServer(tt.candidates)
+			if !ok || got.name != tt.want {
+				t.Errorf("chooseServer = %q, %v; want %q", got.name, ok, tt.want)
+			}
+		})
+	}
+	if _, ok := chooseServer(nil); ok {
+		t.Error("chooseServer(nil) reported a choice")
+	}
+}
+
+func TestMissingStrictFlags(t *testing.T) {
+	parse := func(args ...string) {
+		t.Helper()
+		saved := flag.CommandLine
+		t.Cleanup(func() { flag.CommandLine = saved })
+		flag.CommandLine = flag.NewFlagSet("ispeed", flag.ContinueOnError)
+		for _, names := range strictFlags {
+			for _, name := range names {
+				flag.String(name, "", "")
+			}
+		}
+		if err := flag.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	complete := []string{
+		"-url", "http://127.0.0.1:8080", "-duration", "1s", "-streams", "2",
+		"-chunk-size", "65536", "-total-download-mb", "8", "-ping-count", "3",
+		"-ping-interval", "0", "-ping-retries", "0", "-warmup", "0",
+		"-timeout", "5s", "-download-method", "GET",
+	}
+	parse(complete...)
+	if missing := missingStrictFlags(); len(missing) != 0 {
+		t.Errorf("complete flags reported missing %v", missing)
+	}
+
+	for _, name := range []string{"-ping-interval", "-ping-retries", "-warmup"} {
+		i := slices.Index(complete, name)
+		parse(slices.Delete(slices.Clone(complete), i, i+2)...)
+		if missing := missingStrictFlags(); !slices.Equal(missing, []string{name}) {
+			t.Errorf("without %s, missing = %v", name, missing)
+		}
+	}
+}
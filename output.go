@@ -0,0 +1,594 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatMarkdown = "md"
+	formatCSV      = "csv"
+)
+
+func validFormat(format string) bool {
+	switch format {
+	case formatText, formatJSON, formatMarkdown, formatCSV:
+		return true
+	}
+	return false
+}
+
+func validDurationUnit(unit string) bool {
+	switch unit {
+	case "ms", "us", "ns":
+		return true
+	}
+	return false
+}
+
+func writeResult(w io.Writer, opts cliOptions, server string, result ispeed.Result) {
+	switch opts.Format {
+	case formatMarkdown:
+		writeMarkdown(w, server, result, time.Now())
+	case formatCSV:
+		writeCSV(w, server, result, time.Now(), needsCSVHeader(w))
+	default:
+		writeJSON(w, result, opts.DurationUnit, opts.Decimals)
+	}
+}
+
+// jsonSchemaVersion changes whenever a field of jsonResult is renamed,
+// removed or changes meaning, so parsers can tell which layout they have.
+// Adding a field does not bump it.
+const jsonSchemaVersion = "1"
+
+// jsonResult is the -json output. Numbers are json.Number so they keep the
+// -decimals formatting, and ping fields are nil (null) when ping was skipped.
+// Fields tagged unit hold a duration in -duration-unit; their JSON tags name
+// the millisecond keys and withUnit swaps in the chosen unit.
+type jsonResult struct {
+	SchemaVersion           string       `json:"schema_version"`
+	PingMs                  *json.Number `json:"ping_ms" unit:"ping"`
+	PingAvgMs               *json.Number `json:"ping_avg_ms" unit:"ping_avg"`
+	PingMedianMs            *json.Number `json:"ping_median_ms" unit:"ping_median"`
+	PingP95Ms               *json.Number `json:"ping_p95_ms" unit:"ping_p95"`
+	JitterMs                *json.Number `json:"jitter_ms" unit:"jitter"`
+	DownloadMbps            json.Number  `json:"download_mbps"`
+	DownloadBytes           int64        `json:"download_bytes"`
+	DownloadSeconds         json.Number  `json:"download_seconds"`
+	UploadMbps              json.Number  `json:"upload_mbps"`
+	UploadBytes             int64        `json:"upload_bytes"`
+	UploadSeconds           json.Number  `json:"upload_seconds"`
+	DownloadLoadedLatencyMs json.Number  `json:"download_loaded_latency_ms" unit:"download_loaded_latency"`
+	UploadLoadedLatencyMs   json.Number  `json:"upload_loaded_latency_ms" unit:"upload_loaded_latency"`
+	Aborted                 bool         `json:"aborted"`
+	Protocol                string       `json:"protocol"`
+	IPVersion               string       `json:"ip_version"`
+	Server                  string       `json:"server"`
+	StartedAt               time.Time    `json:"started_at"`
+	EndedAt                 time.Time    `json:"ended_at"`
+	PingError               string       `json:"ping_error,omitempty"`
+	DownloadError           string       `json:"download_error,omitempty"`
+	UploadError             string       `json:"upload_error,omitempty"`
+	Label                   string       `json:"label"`
+	Meta                    *runMeta     `json:"meta,omitempty"`
+	PingTiming              *jsonTiming  `json:"ping_timing,omitempty"`
+	TCP                     *jsonTCP     `json:"tcp,omitempty"`
+	// ServerInfo is the server's /info answer, absent for servers without one.
+	ServerInfo      *ispeed.ServerInfo `json:"server_info,omitempty"`
+	DownloadSamples []jsonSample       `json:"download_samples,omitempty"`
+	RampProfile     []jsonRampStep     `json:"ramp_profile,omitempty"`
+	RampKnee        int                `json:"ramp_knee_streams,omitempty"`
+	RampError       string             `json:"ramp_error,omitempty"`
+	UploadSamples   []jsonSample       `json:"upload_samples,omitempty"`
+}
+
+type jsonRampStep struct {
+	Streams int         `json:"streams"`
+	Mbps    json.Number `json:"mbps"`
+}
+
+type jsonSample struct {
+	ElapsedMs json.Number `json:"elapsed_ms" unit:"elapsed"`
+	Bytes     int64       `json:"bytes"`
+	Mbps      json.Number `json:"mbps"`
+}
+
+type jsonTCP struct {
+	Conns       int         `json:"conns"`
+	Retransmits int         `json:"retransmits"`
+	RTTMs       json.Number `json:"rtt_ms" unit:"rtt"`
+}
+
+type jsonTiming struct {
+	DNSMs     json.Number `json:"dns_ms" unit:"dns"`
+	ConnectMs json.Number `json:"connect_ms" unit:"connect"`
+	TLSMs     json.Number `json:"tls_ms" unit:"tls"`
+	TTFBMs    json.Number `json:"ttfb_ms" unit:"ttfb"`
+}
+
+func newJSONResult(result ispeed.Result, unit string, decimals int) jsonResult {
+	num := func(v float64) json.Number {
+		return json.Number(strconv.FormatFloat(v, 'f', decimals, 64))
+	}
+	// A skipped ping phase is null rather than a misleading 0.
+	ping := func(d time.Duration) *json.Number {
+		if result.Ping.Samples == 0 {
+			return nil
+		}
+		n := num(durationIn(d, unit))
+		return &n
+	}
+	var timing *jsonTiming
+	if result.Config.ConnTrace && result.Ping.Samples > 0 {
+		t := result.Ping.Timing
+		timing = &jsonTiming{
+			DNSMs:     num(durationIn(t.DNS, unit)),
+			ConnectMs: num(durationIn(t.Connect, unit)),
+			TLSMs:     num(durationIn(t.TLS, unit)),
+			TTFBMs:    num(durationIn(t.TTFB, unit)),
+		}
+	}
+	samples := func(items []ispeed.ThroughputSample) []jsonSample {
+		var out []jsonSample
+		for _, s := range items {
+			out = append(out, jsonSample{ElapsedMs: num(durationIn(s.Elapsed, unit)), Bytes: s.Bytes, Mbps: num(s.Mbps)})
+		}
+		return out
+	}
+	var ramp []jsonRampStep
+	for _, step := range result.RampProfile {
+		ramp = append(ramp, jsonRampStep{Streams: step.Streams, Mbps: num(step.Mbps)})
+	}
+	var tcp *jsonTCP
+	if result.TCP.Conns > 0 {
+		tcp = &jsonTCP{
+			Conns:       result.TCP.Conns,
+			Retransmits: result.TCP.Retransmits,
+			RTTMs:       num(durationIn(result.TCP.RTT, unit)),
+		}
+	}
+	return jsonResult{
+		SchemaVersion:           jsonSchemaVersion,
+		PingMs:                  ping(result.Ping.Min),
+		PingAvgMs:               ping(result.Ping.Avg),
+		PingMedianMs:            ping(result.Ping.Median),
+		PingP95Ms:               ping(result.Ping.P95),
+		JitterMs:                ping(result.Ping.Jitter),
+		DownloadMbps:            num(result.Download.Mbps),
+		DownloadBytes:           result.Download.Bytes,
+		DownloadSeconds:         num(result.Download.Duration.Seconds()),
+		UploadMbps:              num(result.Upload.Mbps),
+		UploadBytes:             result.Upload.Bytes,
+		UploadSeconds:           num(result.Upload.Duration.Seconds()),
+		DownloadLoadedLatencyMs: num(durationIn(result.Download.LoadedPing.Avg, unit)),
+		UploadLoadedLatencyMs:   num(durationIn(result.Upload.LoadedPing.Avg, unit)),
+		Aborted:                 result.Aborted,
+		Protocol:                result.Download.Protocol,
+		IPVersion:               result.IPVersion,
+		Server:                  result.Config.BaseURL,
+		StartedAt:               result.StartedAt.UTC(),
+		EndedAt:                 result.EndedAt.UTC(),
+		PingError:               errorText(result.PingErr),
+		DownloadError:           errorText(result.DownloadErr),
+		UploadError:             errorText(result.UploadErr),
+		Label:                   result.Label,
+		Meta:                    newRunMeta(result.Meta),
+		PingTiming:              timing,
+		TCP:                     tcp,
+		ServerInfo:              result.ServerInfo,
+		DownloadSamples:         samples(result.Download.Samples),
+		UploadSamples:           samples(result.Upload.Samples),
+		RampProfile:             ramp,
+		RampKnee:                result.RampKnee,
+		RampError:               errorText(result.RampErr),
+	}
+}
+
+// formatRamp lists the stream ramp as "1: 94.10  2: 181.30 Mbps".
+func formatRamp(profile []ispeed.RampStep) string {
+	parts := make([]string, 0, len(profile))
+	for _, step := range profile {
+		parts = append(parts, fmt.Sprintf("%d: %.2f", step.Streams, step.Mbps))
+	}
+	return strings.Join(parts, "  ") + " Mbps"
+}
+
+func streamsText(n int) string {
+	if n == 1 {
+		return "1 stream"
+	}
+	return fmt.Sprintf("%d streams", n)
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// writeJSON names duration fields after the chosen unit (ping_ms, ping_us,
+// ping_ns) so consumers never have to guess what a number means.
+func writeJSON(w io.Writer, result ispeed.Result, unit string, decimals int) {
+	data, err := json.Marshal(withUnit(newJSONResult(result, unit, decimals), unit))
+	if err != nil {
+		fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
+
+// withUnit copies v into an equivalent struct whose fields tagged unit are
+// keyed in unit rather than milliseconds, so only those fields are renamed.
+// Structs with such fields are rewritten wherever they are nested, behind
+// pointers or in slices.
+func withUnit(v any, unit string) any {
+	if unit == "ms" {
+		return v
+	}
+	value := reflect.ValueOf(v)
+	return copyInto(value, unitType(value.Type(), unit)).Interface()
+}
+
+func unitType(t reflect.Type, unit string) reflect.Type {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return reflect.PointerTo(unitType(t.Elem(), unit))
+	case reflect.Slice:
+		return reflect.SliceOf(unitType(t.Elem(), unit))
+	}
+	if t.Kind() != reflect.Struct {
+		return t
+	}
+
+	fields := make([]reflect.StructField, t.NumField())
+	changed := false
+	for i := range fields {
+		field := t.Field(i)
+		if name, ok := field.Tag.Lookup("unit"); ok {
+			_, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if opts != "" {
+				opts = "," + opts
+			}
+			field.Tag = reflect.StructTag(`json:"` + name + "_" + unit + opts + `"`)
+		} else {
+			field.Type = unitType(field.Type, unit)
+		}
+		changed = changed || field.Type != t.Field(i).Type || field.Tag != t.Field(i).Tag
+		fields[i] = field
+	}
+	if !changed {
+		return t
+	}
+	return reflect.StructOf(fields)
+}
+
+// copyInto copies v into t, a type unitType derived from v's type.
+func copyInto(v reflect.Value, t reflect.Type) reflect.Value {
+	if v.Type() == t {
+		return v
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		out := reflect.New(t.Elem())
+		out.Elem().Set(copyInto(v.Elem(), t.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		out := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := range v.Len() {
+			out.Index(i).Set(copyInto(v.Index(i), t.Elem()))
+		}
+		return out
+	}
+	out := reflect.New(t).Elem()
+	for i := range t.NumField() {
+		out.Field(i).Set(copyInto(v.Field(i), t.Field(i).Type))
+	}
+	return out
+}
+
+// runMeta is the JSON form of ispeed.Meta shared by -json and history output.
+type runMeta struct {
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Hostname string `json:"hostname,omitempty"`
+	Version  string `json:"version"`
+}
+
+func newRunMeta(meta ispeed.Meta) *runMeta {
+	if meta == (ispeed.Meta{}) {
+		return nil
+	}
+	return &runMeta{OS: meta.OS, Arch: meta.Arch, Hostname: meta.Hostname, Version: meta.Version}
+}
+
+func durationIn(d time.Duration, unit string) float64 {
+	switch unit {
+	case "us":
+		return d.Seconds() * 1e6
+	case "ns":
+		return float64(d.Nanoseconds())
+	}
+	return durationMs(d)
+}
+
+func writeMarkdown(w io.Writer, server string, result ispeed.Result, at time.Time) {
+	fmt.Fprintln(w, "## ispeed result")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Metric | Value |")
+	fmt.Fprintln(w, "| --- | --- |")
+	fmt.Fprintf(w, "| Ping (min) | %s |\n", pingText(result.Ping, result.Ping.Min))
+	fmt.Fprintf(w, "| Ping (avg) | %s |\n", pingText(result.Ping, result.Ping.Avg))
+	fmt.Fprintf(w, "| Ping (median) | %s |\n", pingText(result.Ping, result.Ping.Median))
+	fmt.Fprintf(w, "| Ping (p95) | %s |\n", pingText(result.Ping, result.Ping.P95))
+	fmt.Fprintf(w, "| Jitter | %s |\n", pingText(result.Ping, result.Ping.Jitter))
+	fmt.Fprintf(w, "| Download | %.2f Mbps |\n", result.Download.Mbps)
+	fmt.Fprintf(w, "| Upload | %.2f Mbps |\n", result.Upload.Mbps)
+	fmt.Fprintln(w)
+	for _, phase := range []struct {
+		name string
+		err  error
+	}{{"Ping", result.PingErr}, {"Stream ramp", result.RampErr}, {"Download", result.DownloadErr}, {"Upload", result.UploadErr}} {
+		if phase.err != nil {
+			fmt.Fprintf(w, "- %s failed: %v\n", phase.name, phase.err)
+		}
+	}
+	if result.Label != "" {
+		fmt.Fprintf(w, "- Label: %s\n", result.Label)
+	}
+	fmt.Fprintf(w, "- Server: %s\n", server)
+	if result.Download.Protocol != "" {
+		fmt.Fprintf(w, "- Protocol: %s\n", result.Download.Protocol)
+	}
+	fmt.Fprintf(w, "- Time: %s\n", at.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "- Version: %s\n", ispeed.Version)
+}
+
+// csvHeader grows only at the end, so files appended to across versions keep
+// their existing columns in place.
+var csvHeader = []string{"time", "server", "ping_ms", "jitter_ms", "download_mbps", "upload_mbps", "label"}
+
+// writeCSV writes one row per run so a cron job can keep appending to the same
+// file. Ping cells are empty when the ping phase was skipped.
+func writeCSV(w io.Writer, server string, result ispeed.Result, at time.Time, header bool) {
+	ping := func(d time.Duration) string {
+		if result.Ping.Samples == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(durationMs(d), 'f', 2, 64)
+	}
+	out := csv.NewWriter(w)
+	if header {
+		_ = out.Write(csvHeader)
+	}
+	_ = out.Write([]string{
+		at.UTC().Format(time.RFC3339),
+		server,
+		ping(result.Ping.Min),
+		ping(result.Ping.Jitter),
+		strconv.FormatFloat(result.Download.Mbps, 'f', 2, 64),
+		strconv.FormatFloat(result.Upload.Mbps, 'f', 2, 64),
+		result.Label,
+	})
+	out.Flush()
+}
+
+// needsCSVHeader reports whether w starts a new CSV file. Only a regular file
+// that already has content skips the header; a terminal or pipe gets one.
+func needsCSVHeader(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return true
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return true
+	}
+	return info.Size() == 0
+}
+
+// writePrometheus writes the result in the Prometheus text format for the
+// node_exporter textfile collector. Phases that failed or did not run are
+// left out rather than reported as 0.
+func writePrometheus(w io.Writer, server string, result ispeed.Result, at time.Time) {
+	label := fmt.Sprintf("{server=\"%s\"}", escapePrometheusLabel(server))
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, help, name, name, label, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	if result.Ping.Samples > 0 {
+		gauge("ispeed_ping_ms", "Lowest ping of the last run in milliseconds.", durationMs(result.Ping.Min))
+	}
+	if result.DownloadErr == nil && !result.Aborted {
+		gauge("ispeed_download_mbps", "Download rate of the last run in Mbps.", result.Download.Mbps)
+	}
+	if result.UploadErr == nil && !result.Aborted {
+		gauge("ispeed_upload_mbps", "Upload rate of the last run in Mbps.", result.Upload.Mbps)
+	}
+	gauge("ispeed_last_run_timestamp_seconds", "Unix time the last run finished.", float64(at.Unix()))
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePrometheusLabel(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
+
+// writeFileAtomic replaces path with the output of write in one rename, so a
+// collector reading the file never sees it half written.
+func writeFileAtomic(path string, write func(io.Writer)) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	write(tmp)
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pingText formats one ping statistic, or "n/a" when the ping phase was
+// skipped and there is nothing to show.
+func pingText(metrics ispeed.PingMetrics, d time.Duration) string {
+	if metrics.Samples == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f ms", durationMs(d))
+}
+
+func durationMs(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+// writeExplanation describes how each number in the result was produced, for
+// users who want to check the method before trusting the figures.
+func writeExplanation(w io.Writer, result ispeed.Result) {
+	fmt.Fprintln(w, "How these numbers were measured:")
+	if result.Ping.Samples == 0 {
+		fmt.Fprintln(w, "  Ping: skipped.")
+	} else {
+		how := "sequential /ping round trips"
+		if result.Config.PingMode == ispeed.PingModeWebSocket {
+			how = "echoes over one /ws-ping WebSocket"
+		}
+		fmt.Fprintf(w, "  Ping: lowest of %d %s (avg %.2f ms, median %.2f ms, p95 %.2f ms).\n",
+			result.Ping.Samples, how, durationMs(result.Ping.Avg), durationMs(result.Ping.Median), durationMs(result.Ping.P95))
+		if result.Ping.Retransmits > 0 {
+			fmt.Fprintf(w, "    %d ping requests failed and were retried.\n", result.Ping.Retransmits)
+		}
+	}
+	explainSpeed(w, "Download", result.Download)
+	explainSpeed(w, "Upload", result.Upload)
+	if result.Upload.StaticPayload {
+		fmt.Fprintln(w, "  The upload repeated one buffer, which a compressing link can inflate.")
+	} else {
+		fmt.Fprintln(w, "  The upload sent random data, which does not compress.")
+	}
+	if result.Download.LoadedPing.Samples > 0 || result.Upload.LoadedPing.Samples > 0 {
+		fmt.Fprintf(w, "  Loaded ping: average of %d and %d /ping round trips taken during the download and upload, compared with the idle average.\n",
+			result.Download.LoadedPing.Samples, result.Upload.LoadedPing.Samples)
+	}
+	if result.TCP.Conns > 0 {
+		fmt.Fprintf(w, "  TCP: the kernel retransmitted %d segments over %d connections, with a mean smoothed RTT of %.2f ms.\n",
+			result.TCP.Retransmits, result.TCP.Conns, durationMs(result.TCP.RTT))
+	}
+}
+
+func explainSpeed(w io.Writer, phase string, metrics ispeed.SpeedMetrics) {
+	warmup := "no warmup excluded"
+	basis := "all bytes over the wall-clock time of the phase"
+	if metrics.Warmup > 0 {
+		warmup = fmt.Sprintf("after a %s warmup that is not counted", metrics.Warmup.Round(time.Millisecond))
+		basis = "the bytes after the warmup over the wall-clock time after it"
+	}
+	fmt.Fprintf(w, "  %s: %d bytes in %d requests over %d streams in %s, %s.\n",
+		phase, metrics.Bytes, metrics.Requests, metrics.Streams, metrics.Duration.Round(time.Millisecond), warmup)
+	fmt.Fprintf(w, "    %.2f Mbps is %s; the per-stream rates add up to %.2f Mbps.\n",
+		metrics.Mbps, basis, metrics.StreamSumMbps)
+	if len(metrics.StreamMbps) > 1 {
+		rates := make([]string, len(metrics.StreamMbps))
+		for i, rate := range metrics.StreamMbps {
+			rates[i] = strconv.FormatFloat(rate, 'f', 2, 64)
+		}
+		fmt.Fprintf(w, "    Per stream: %s Mbps (standard deviation %.2f Mbps).\n",
+			strings.Join(rates, ", "), metrics.StdDevMbps)
+	}
+	if metrics.Settled {
+		fmt.Fprintln(w, "    Stopped early because the rate had settled.")
+	}
+}
+
+const (
+	histogramBuckets    = 8
+	histogramMinSamples = 3
+	histogramBarWidth   = 30
+)
+
+type histogramBucket struct {
+	Low   time.Duration
+	High  time.Duration
+	Count int
+}
+
+// bucketDurations spreads samples over n equal-width buckets between the
+// smallest and largest sample. Equal samples all land in a single bucket.
+func bucketDurations(samples []time.Duration, n int) []histogramBucket {
+	if len(samples) == 0 || n < 1 {
+		return nil
+	}
+	low, high := slices.Min(samples), slices.Max(samples)
+	if low == high {
+		return []histogramBucket{{Low: low, High: high, Count: len(samples)}}
+	}
+
+	width := (high - low) / time.Duration(n)
+	if width <= 0 {
+		width = 1
+		n = int(high-low) + 1
+	}
+	buckets := make([]histogramBucket, n)
+	for i := range buckets {
+		buckets[i].Low = low + time.Duration(i)*width
+		buckets[i].High = buckets[i].Low + width
+	}
+	buckets[n-1].High = high
+	for _, sample := range samples {
+		i := min(int((sample-low)/width), n-1)
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+func writePingHistogram(w io.Writer, samples []time.Duration) {
+	if len(samples) < histogramMinSamples {
+		fmt.Fprintf(w, "Ping histogram skipped: need at least %d samples, have %d\n", histogramMinSamples, len(samples))
+		return
+	}
+
+	buckets := bucketDurations(samples, histogramBuckets)
+	peak := 0
+	for _, bucket := range buckets {
+		peak = max(peak, bucket.Count)
+	}
+	fmt.Fprintln(w, "Ping histogram (ms):")
+	for _, bucket := range buckets {
+		bar := strings.Repeat("#", bucket.Count*histogramBarWidth/peak)
+		fmt.Fprintf(w, "  %8.2f - %8.2f | %-*s %d\n", durationMs(bucket.Low), durationMs(bucket.High), histogramBarWidth, bar, bucket.Count)
+	}
+}
+
+// writeConfig prints the configuration a run used, with defaults applied.
+// Durations are in nanoseconds, as encoding/json writes time.Duration.
+func writeConfig(w io.Writer, cfg ispeed.ClientConfig) {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "config: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
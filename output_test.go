@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+func TestLabelRoundTrip(t *testing.T) {
+	const label = "before VPN"
+	result := ispeed.Result{Label: label, Download: ispeed.SpeedMetrics{Mbps: 100}}
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeJSON(&buf, result, "ms", 2)
+		var decoded jsonResult
+		if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Label != label {
+			t.Errorf("label = %q, want %q", decoded.Label, label)
+		}
+	})
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeCSV(&buf, "http://example", result, time.Now(), true)
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("got %d rows, want header and one row", len(rows))
+		}
+		col := len(csvHeader) - 1
+		if rows[0][col] != "label" || rows[1][col] != label {
+			t.Errorf("label column = %q/%q, want label/%q", rows[0][col], rows[1][col], label)
+		}
+	})
+	t.Run("history", func(t *testing.T) {
+		data, err := json.Marshal(newHistoryEntry("http://example", result))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Label != label {
+			t.Errorf("label = %q, want %q", entry.Label, label)
+		}
+	})
+}
+
+func TestJSONSubMillisecondPing(t *testing.T) {
+	result := ispeed.Result{Ping: ispeed.PingMetrics{Min: 500 * time.Microsecond, Samples: 1}}
+	for _, tt := range []struct {
+		unit  string
+		field string
+		want  float64
+	}{
+		{"ms", "ping_ms", 0.5},
+		{"us", "ping_us", 500},
+		{"ns", "ping_ns", 500_000},
+	} {
+		t.Run(tt.unit, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeJSON(&buf, result, tt.unit, 2)
+			var decoded map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if got := decoded[tt.field]; got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONDurationUnitKeys(t *testing.T) {
+	result := ispeed.Result{
+		Ping: ispeed.PingMetrics{Min: time.Millisecond, Samples: 1},
+		// Neither a string value nor a key outside -duration-unit changes.
+		Label:    `x_ms":1`,
+		Download: ispeed.SpeedMetrics{Samples: []ispeed.ThroughputSample{{Elapsed: time.Second, Bytes: 1}}},
+		TCP:      ispeed.TCPStats{Conns: 1, RTT: time.Millisecond},
+		Config:   ispeed.ClientConfig{ConnTrace: true},
+	}
+	var buf bytes.Buffer
+	writeJSON(&buf, result, "us", 0)
+	var decoded struct {
+		PingUs          *float64 `json:"ping_us"`
+		PingMs          *float64 `json:"ping_ms"`
+		DownloadSeconds *float64 `json:"download_seconds"`
+		Label           string   `json:"label"`
+		DownloadSamples []struct {
+			ElapsedUs *float64 `json:"elapsed_us"`
+		} `json:"download_samples"`
+		TCP struct {
+			RTTUs *float64 `json:"rtt_us"`
+		} `json:"tcp"`
+		PingTiming struct {
+			DNSUs  *float64 `json:"dns_us"`
+			TTFBUs *float64 `json:"ttfb_us"`
+		} `json:"ping_timing"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case decoded.PingUs == nil || *decoded.PingUs != 1000 || decoded.PingMs != nil:
+		t.Errorf("ping keys wrong in %s", buf.Bytes())
+	case decoded.DownloadSeconds == nil || decoded.Label != result.Label:
+		t.Errorf("fields outside -duration-unit changed in %s", buf.Bytes())
+	case len(decoded.DownloadSamples) != 1 || decoded.DownloadSamples[0].ElapsedUs == nil || *decoded.DownloadSamples[0].ElapsedUs != 1e6:
+		t.Errorf("sample elapsed not in us in %s", buf.Bytes())
+	case decoded.TCP.RTTUs == nil || decoded.PingTiming.DNSUs == nil || decoded.PingTiming.TTFBUs == nil:
+		t.Errorf("nested duration keys not in us in %s", buf.Bytes())
+	}
+	label, _ := json.Marshal(result.Label)
+	if strings.Contains(strings.ReplaceAll(buf.String(), string(label), ""), "_ms") {
+		t.Errorf("millisecond key left in %s", buf.Bytes())
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestWriteMarkdownGolden(t *testing.T) {
+	// Pin what a build could change, so the files only follow the layout.
+	saved := ispeed.Version
+	t.Cleanup(func() { ispeed.Version = saved })
+	ispeed.Version = "1.0.0"
+	at := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		result ispeed.Result
+	}{
+		{"full", ispeed.Result{
+			Ping:     ispeed.PingMetrics{Min: 12 * ms, Avg: 14 * ms, Median: 13 * ms, P95: 20 * ms, Jitter: 1500 * time.Microsecond, Samples: 6},
+			Download: ispeed.SpeedMetrics{Mbps: 245.678, Protocol: "h2"},
+			Upload:   ispeed.SpeedMetrics{Mbps: 41.2},
+			Label:    "after VPN",
+		}},
+		{"no_ping_failed_upload", ispeed.Result{
+			Download:  ispeed.SpeedMetrics{Mbps: 98.5, Protocol: "http/1.1"},
+			UploadErr: errors.New("upload endpoint returned 413 Request Entity Too Large"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeMarkdown(&buf, "https://speed.example.com", tt.result, at)
+
+			golden := filepath.Join("testdata", "markdown_"+tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("markdown differs from %s (run with -update to accept):\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestBucketDurations(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		out := make([]time.Duration, len(n))
+		for i, v := range n {
+			out[i] = time.Duration(v) * time.Millisecond
+		}
+		return out
+	}
+	for _, tt := range []struct {
+		name    string
+		samples []time.Duration
+		n       int
+		want    []histogramBucket
+	}{
+		{"empty", nil, 4, nil},
+		{"no buckets", ms(1, 2), 0, nil},
+		{"single value", ms(5, 5, 5), 4, []histogramBucket{
+			{Low: 5 * time.Millisecond, High: 5 * time.Millisecond, Count: 3},
+		}},
+		{"max in last bucket", ms(0, 1, 4, 9, 10), 2, []histogramBucket{
+			{Low: 0, High: 5 * time.Millisecond, Count: 3},
+			{Low: 5 * time.Millisecond, High: 10 * time.Millisecond, Count: 2},
+		}},
+		// 10ms does not split evenly in three, so the last bucket absorbs
+		// the remainder and still ends at the maximum.
+		{"uneven width", ms(0, 4, 9, 10), 3, []histogramBucket{
+			{Low: 0, High: 3333333 * time.Nanosecond, Count: 1},
+			{Low: 3333333 * time.Nanosecond, High: 6666666 * time.Nanosecond, Count: 1},
+			{Low: 6666666 * time.Nanosecond, High: 10 * time.Millisecond, Count: 2},
+		}},
+		// A spread narrower than n nanoseconds gets one-nanosecond buckets.
+		{"narrow spread", []time.Duration{1, 3}, 5, []histogramBucket{
+			{Low: 1, High: 2, Count: 1},
+			{Low: 2, High: 3, Count: 0},
+			{Low: 3, High: 3, Count: 1},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bucketDurations(tt.samples, tt.n)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("bucketDurations(%v, %d) = %v, want %v", tt.samples, tt.n, got, tt.want)
+			}
+			total := 0
+			for _, b := range got {
+				total += b.Count
+			}
+			if len(tt.want) > 0 && total != len(tt.samples) {
+				t.Errorf("buckets hold %d samples, want %d", total, len(tt.samples))
+			}
+		})
+	}
+}
+
+func TestExplainSpeedWarmup(t *testing.T) {
+	for _, tt := range []struct {
+		warmup time.Duration
+		want   string
+	}{
+		{0, "all bytes over the wall-clock time of the phase"},
+		{time.Second, "the bytes after the warmup over the wall-clock time after it"},
+	} {
+		var buf bytes.Buffer
+		explainSpeed(&buf, "download", ispeed.SpeedMetrics{Mbps: 100, Warmup: tt.warmup})
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("warmup %v: explanation %q does not say %q", tt.warmup, buf.String(), tt.want)
+		}
+	}
+}
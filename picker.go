@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+type pickerEntry struct {
+	name    string
+	url     string
+	latency time.Duration
+	probed  bool
+	err     error
+}
+
+type probeMsg struct {
+	index   int
+	latency time.Duration
+	err     error
+}
+
+type serverPicker struct {
+	entries []pickerEntry
+	cursor  int
+}
+
+func newServerPicker(servers []serverEntry) *serverPicker {
+	picker := &serverPicker{}
+	for _, server := range servers {
+		if server.URL == "" {
+			continue
+		}
+		picker.entries = append(picker.entries, pickerEntry{name: server.Name, url: strings.TrimRight(server.URL, "/")})
+	}
+	return picker
+}
+
+// probeAll returns one command per entry that pings it. Bubble Tea runs them
+// all at once, so they share a semaphore that holds the probes in flight to
+// cfg.MaxProbeConcurrency, as during automatic selection.
+func (p *serverPicker) probeAll(cfg ispeed.ClientConfig) []tea.Cmd {
+	client := &http.Client{Timeout: 4 * time.Second}
+	sem := make(chan struct{}, probeConcurrency(cfg))
+	cmds := make([]tea.Cmd, 0, len(p.entries))
+	for i, entry := range p.entries {
+		cmds = append(cmds, func() tea.Msg {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			latency, err := ispeed.PingOnce(context.Background(), client, entry.url)
+			return probeMsg{index: i, latency: latency, err: err}
+		})
+	}
+	return cmds
+}
+
+func (m model) updatePicker(msg tea.Msg) (tea.Model, tea.Cmd) {
+	picker := m.picker
+	switch typed := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = typed.Width
+	case probeMsg:
+		entry := &picker.entries[typed.index]
+		entry.latency, entry.err, entry.probed = typed.latency, typed.err, true
+	case tea.KeyMsg:
+		switch typed.String() {
+		case "up", "k":
+			if picker.cursor > 0 {
+				picker.cursor--
+			}
+		case "down", "j":
+			if picker.cursor < len(picker.entries)-1 {
+				picker.cursor++
+			}
+		case "enter":
+			if len(picker.entries) == 0 {
+				return m, nil
+			}
+			m.cfg.BaseURL = picker.entries[picker.cursor].url
+			m.picker = nil
+			m.start(m.cfg)
+		case "q", "esc", "ctrl+c":
+			m.picker = nil
+			m.err = errors.New("no server selected")
+			return m, tea.Quit
+		}
+	}
+	return m, nil
+}
+
+func (p *serverPicker) view(title string) string {
+	hintStyle := lipgloss.NewStyle().Foreground(colors.muted)
+	cursorStyle := lipgloss.NewStyle().Foreground(colors.accent).Bold(true)
+
+	content := []string{title, hintStyle.Render("select a server (enter to start, q to quit)"), ""}
+	if len(p.entries) == 0 {
+		content = append(content, hintStyle.Render("no servers defined in config"))
+	}
+	for i, entry := range p.entries {
+		latency := "probing..."
+		switch {
+		case entry.err != nil:
+			latency = "unreachable"
+		case entry.probed:
+			latency = fmt.Sprintf("%6.2f ms", durationMs(entry.latency))
+		}
+		line := fmt.Sprintf("%-20s %-40s %s", entry.name, entry.url, hintStyle.Render(latency))
+		if i == p.cursor {
+			line = cursorStyle.Render("> ") + line
+		} else {
+			line = "  " + line
+		}
+		content = append(content, line)
+	}
+
+	return strings.Join(content, "\n") + "\n"
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yashsinghcodes/ispeed/pkg/ispeed"
+)
+
+func TestPickerProbeConcurrencyCap(t *testing.T) {
+	server := newInFlightServer(t)
+	servers := make([]serverEntry, 12)
+	for i := range servers {
+		servers[i] = serverEntry{Name: "s", URL: server.URL}
+	}
+
+	// Bubble Tea runs every command of a batch in its own goroutine.
+	var wg sync.WaitGroup
+	for _, cmd := range newServerPicker(servers).probeAll(ispeed.ClientConfig{MaxProbeConcurrency: 2}) {
+		wg.Go(func() {
+			if msg := cmd().(probeMsg); msg.err != nil {
+				t.Errorf("probe %d: %v", msg.index, msg.err)
+			}
+		})
+	}
+	wg.Wait()
+	if peak := atomic.LoadInt64(&server.peak); peak > 2 {
+		t.Errorf("%d probes in flight at once, want at most 2", peak)
+	}
+}
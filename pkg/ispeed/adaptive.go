@@ -0,0 +1,90 @@
+package ispeed
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// stableSampleInterval is how often the adaptive rule samples the rate.
+	stableSampleInterval = 250 * time.Millisecond
+	// stableWindowSamples is the sliding window the rule judges, 2s of rates.
+	stableWindowSamples = 8
+)
+
+// adaptive reports whether cfg asks for phases that stop once their rate has
+// settled.
+func (c ClientConfig) adaptive() bool {
+	return c.MaxDuration > 0 && c.RequestCount == 0
+}
+
+// watchStability samples the phase's byte counter and calls stop once the
+// rate over the last stableWindowSamples intervals varies by less than
+// cfg.StableCV (standard deviation over mean), but not before MinDuration.
+// Without adaptive stopping it does nothing. The returned func ends the watch
+// and reports whether it stopped the phase.
+func watchStability(ctx context.Context, cfg ClientConfig, total *int64, since func() time.Duration, stop context.CancelFunc) func() bool {
+	if !cfg.adaptive() {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var settled atomic.Bool
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(stableSampleInterval)
+		defer ticker.Stop()
+		rates := make([]float64, 0, stableWindowSamples)
+		last := atomic.LoadInt64(total)
+		lastAt := since()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, at := atomic.LoadInt64(total), since()
+			rate := bytesToMbps(current-last, at-lastAt)
+			last, lastAt = current, at
+			if len(rates) == stableWindowSamples {
+				rates = rates[1:]
+			}
+			rates = append(rates, rate)
+			if at < cfg.MinDuration || len(rates) < stableWindowSamples {
+				continue
+			}
+			if coefficientOfVariation(rates) < cfg.StableCV {
+				settled.Store(true)
+				stop()
+				return
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-finished
+		return settled.Load()
+	}
+}
+
+// coefficientOfVariation is the standard deviation of values over their mean,
+// or +Inf when the mean is zero.
+func coefficientOfVariation(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if mean <= 0 {
+		return math.Inf(1)
+	}
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(squares/float64(len(values))) / mean
+}
@@ -0,0 +1,139 @@
+package ispeed
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// strictConfig sets every field normalizeClientConfig would otherwise fill in.
+func strictConfig() ClientConfig {
+	return ClientConfig{
+		BaseURL:        "http://127.0.0.1:8080",
+		Duration:       time.Second,
+		Streams:        2,
+		ChunkSize:      DefaultChunkSize,
+		DownloadMB:     1,
+		PingCount:      3,
+		PingInterval:   0,
+		PingRetries:    -1,
+		WarmupDuration: -1,
+		Timeout:        time.Second,
+		DownloadMethod: "GET",
+		Strict:         true,
+	}
+}
+
+func TestStrictAcceptsCompleteConfig(t *testing.T) {
+	if _, err := normalizeClientConfig(strictConfig()); err != nil {
+		t.Fatalf("normalizeClientConfig: %v", err)
+	}
+	adaptive := strictConfig()
+	adaptive.MaxDuration = 2 * time.Second
+	adaptive.MinDuration = time.Second
+	adaptive.StableCV = 0.1
+	if _, err := normalizeClientConfig(adaptive); err != nil {
+		t.Fatalf("normalizeClientConfig adaptive: %v", err)
+	}
+	// The CLI defaults for -warmup, -ping-interval and -ping-retries are
+	// valid explicit values too.
+	defaults := strictConfig()
+	defaults.WarmupDuration = DefaultWarmup
+	defaults.PingInterval = DefaultPingInterval
+	defaults.PingRetries = DefaultPingRetries
+	got, err := normalizeClientConfig(defaults)
+	if err != nil {
+		t.Fatalf("normalizeClientConfig defaults: %v", err)
+	}
+	if got.WarmupDuration != DefaultWarmup || got.PingInterval != DefaultPingInterval || got.PingRetries != DefaultPingRetries {
+		t.Errorf("strict changed explicit values: warmup %v, interval %v, retries %d", got.WarmupDuration, got.PingInterval, got.PingRetries)
+	}
+}
+
+func TestStrictRejectsEachField(t *testing.T) {
+	tests := []struct {
+		field  string
+		modify func(*ClientConfig)
+	}{
+		{"BaseURL", func(c *ClientConfig) { c.BaseURL = "" }},
+		{"Duration", func(c *ClientConfig) { c.Duration = 0 }},
+		{"Streams", func(c *ClientConfig) { c.Streams = 0 }},
+		{"DownloadStreams", func(c *ClientConfig) { c.DownloadStreams = -1 }},
+		{"UploadStreams", func(c *ClientConfig) { c.UploadStreams = -1 }},
+		{"ChunkSize", func(c *ClientConfig) { c.ChunkSize = 0 }},
+		{"DownloadMB", func(c *ClientConfig) { c.DownloadMB = 0 }},
+		{"SizeJitterPct", func(c *ClientConfig) { c.SizeJitterPct = 95 }},
+		{"PingCount", func(c *ClientConfig) { c.PingCount = 0 }},
+		{"WarmupDuration", func(c *ClientConfig) { c.WarmupDuration = 0 }},
+		{"MinDuration", func(c *ClientConfig) {
+			c.MaxDuration, c.MinDuration, c.StableCV = time.Second, 2*time.Second, 0.1
+		}},
+		{"StableCV", func(c *ClientConfig) { c.MaxDuration = time.Second }},
+		{"PingInterval", func(c *ClientConfig) { c.PingInterval = -time.Second }},
+		{"PingRetries", func(c *ClientConfig) { c.PingRetries = 0 }},
+		{"Timeout", func(c *ClientConfig) { c.Timeout = 0 }},
+		{"PingMode", func(c *ClientConfig) { c.PingMode = "icmp" }},
+		{"IPVersion", func(c *ClientConfig) { c.IPVersion = "5" }},
+		{"DownloadMode", func(c *ClientConfig) { c.DownloadMode = "forever" }},
+		{"DownloadMethod", func(c *ClientConfig) { c.DownloadMethod = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			cfg := strictConfig()
+			tt.modify(&cfg)
+			_, err := normalizeClientConfig(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.field) {
+				t.Fatalf("err = %v, want a strict error for %s", err, tt.field)
+			}
+
+			// Without Strict the same config falls back quietly.
+			cfg.Strict = false
+			if _, err := normalizeClientConfig(cfg); err != nil {
+				t.Fatalf("non-strict: %v", err)
+			}
+		})
+	}
+}
+
+func TestClientConfigJSONRoundTrip(t *testing.T) {
+	// Fill every serializable field through reflection, so a field added
+	// later without JSON support fails here.
+	var cfg ClientConfig
+	v := reflect.ValueOf(&cfg).Elem()
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.String:
+			f.SetString(field.Name)
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(i + 1))
+		case reflect.Float64:
+			f.SetFloat(float64(i) + 0.5)
+		default:
+			t.Fatalf("no test value for %s of kind %s", field.Name, f.Kind())
+		}
+	}
+	// The callbacks are left out rather than making Marshal fail.
+	cfg.Progress = func(ProgressUpdate) {}
+	cfg.AddProgressSink(func(ProgressUpdate) {})
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ClientConfig
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Progress, cfg.ProgressSinks = nil, nil
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("round trip through %s\ngot  %+v\nwant %+v", data, got, cfg)
+	}
+}
@@ -0,0 +1,53 @@
+package ispeed
+
+import (
+	"context"
+	"sync"
+)
+
+// RunHandle is a test started with StartClient. It offers a pull-based view of
+// progress for callers that would rather poll than register a callback.
+type RunHandle struct {
+	mu      sync.Mutex
+	current ProgressUpdate
+	done    chan struct{}
+	result  Result
+	err     error
+}
+
+// StartClient runs RunClientContext in the background. Any Progress or
+// ProgressSinks in cfg still receive every update.
+func StartClient(ctx context.Context, cfg ClientConfig) *RunHandle {
+	h := &RunHandle{done: make(chan struct{})}
+	cfg.ProgressSinks = append([]func(ProgressUpdate){}, cfg.ProgressSinks...)
+	cfg.AddProgressSink(func(update ProgressUpdate) {
+		h.mu.Lock()
+		h.current = update
+		h.mu.Unlock()
+	})
+
+	go func() {
+		defer close(h.done)
+		h.result, h.err = RunClientContext(ctx, cfg)
+	}()
+	return h
+}
+
+// Current returns the most recent progress update. It is safe to call from
+// any goroutine and returns the zero value before the first update.
+func (h *RunHandle) Current() ProgressUpdate {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// Done is closed when the test has finished.
+func (h *RunHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the test finishes and returns its outcome.
+func (h *RunHandle) Wait() (Result, error) {
+	<-h.done
+	return h.result, h.err
+}
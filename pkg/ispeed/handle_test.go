@@ -0,0 +1,47 @@
+package ispeed
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestRunHandleConcurrentCurrent(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	h := StartClient(context.Background(), testConfig(server.URL))
+
+	phases := []string{"", "ping", "download", "upload"}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			last := 0
+			for {
+				select {
+				case <-h.Done():
+					return
+				default:
+				}
+				update := h.Current()
+				// Every snapshot is one whole update, and the phases
+				// only ever move forward.
+				phase := slices.Index(phases, update.Phase)
+				if phase < last || update.Percent < 0 || update.Percent > 100 ||
+					update.TotalBytes > 0 && update.Bytes > update.TotalBytes {
+					t.Errorf("inconsistent snapshot after phase %q: %+v", phases[last], update)
+					return
+				}
+				last = phase
+			}
+		})
+	}
+
+	result, err := h.Wait()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final := h.Current(); final.Phase != "upload" || !final.Final || final.Mbps != result.Upload.Mbps {
+		t.Errorf("Current after the run = %+v, want the final upload update", final)
+	}
+}
@@ -3,12 +3,20 @@ package ispeed
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	mathrand "math/rand/v2"
 	"net/http"
+	"net/http/httptrace"
+	"os"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,104 +24,698 @@ import (
 )
 
 func RunClient(cfg ClientConfig) (Result, error) {
-	cfg = normalizeClientConfig(cfg)
-	client := &http.Client{Timeout: cfg.Timeout}
+	return RunClientContext(context.Background(), cfg)
+}
 
-	pingRes, err := runPing(client, cfg)
+// RunClientContext is RunClient that stops early, returning ctx.Err(), when
+// ctx is done.
+func RunClientContext(ctx context.Context, cfg ClientConfig) (Result, error) {
+	if cfg.DownloadMB > 0 && cfg.TotalDownloadMB > 0 {
+		return Result{}, errors.New("DownloadMB and TotalDownloadMB are mutually exclusive")
+	}
+	cfg, err := normalizeClientConfig(cfg)
 	if err != nil {
 		return Result{}, err
 	}
-
-	downloadRes, err := runDownload(client, cfg)
+	dialCfg := cfg
+	var tcp *tcpCollector
+	if cfg.TCPInfo {
+		tcp = &tcpCollector{}
+		dialCfg.DialContext = tcp.wrap(cfg.DialContext)
+	}
+	client, err := newHTTPClient(dialCfg)
 	if err != nil {
 		return Result{}, err
 	}
+	startedAt := time.Now()
+	ctx, ipVersion := traceIPVersion(ctx)
+	info := fetchServerInfo(ctx, client, cfg)
+	if info != nil {
+		cfg.maxDownloadBytes = info.MaxDownloadBytes
+		cfg.maxUploadBytes = info.MaxUploadBytes
+	}
+	// The first ping should open its own connection, as it did before /info.
+	client.CloseIdleConnections()
 
-	uploadRes, err := runUpload(client, cfg)
-	if err != nil {
+	// A failed phase is recorded in the result and the run goes on, so a server
+	// without upload support still yields ping and download numbers.
+	var pingRes PingMetrics
+	var pingErr error
+	if !cfg.SkipPing {
+		switch {
+		case cfg.PingMode == PingModeWebSocket && info != nil && !info.WebSocketPing:
+			pingErr = fmt.Errorf("websocket ping: %w", ErrUnsupported)
+		case cfg.PingMode == PingModeWebSocket:
+			pingRes, pingErr = runWebSocketPing(ctx, client, cfg)
+		default:
+			pingRes, pingErr = runPing(ctx, client, &cfg)
+		}
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		if pingErr == nil && cfg.MaxStartupPing > 0 && pingRes.Avg > cfg.MaxStartupPing {
+			return Result{Ping: pingRes, Aborted: true, Label: cfg.Label, StartedAt: startedAt, EndedAt: time.Now(), Config: cfg, Meta: collectMeta(cfg)}, nil
+		}
+	}
+
+	var smallPenalty time.Duration
+	if cfg.SmallTransferProbe {
+		// The probe is an experimental diagnostic: when it fails the penalty
+		// stays zero and the actual test still runs.
+		smallPenalty, _ = runSmallTransferProbe(ctx, client, cfg, pingRes.Min)
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var rampProfile []RampStep
+	var rampKnee int
+	var rampErr error
+	if cfg.RampStreams {
+		rampProfile, rampKnee, rampErr = runRamp(ctx, client, cfg)
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		client.CloseIdleConnections()
+	}
+
+	downloadRes, downloadHost, downloadErr := runDownload(ctx, client, cfg)
+	if err := ctx.Err(); err != nil {
 		return Result{}, err
 	}
 
-	return Result{Ping: pingRes, Download: downloadRes, Upload: uploadRes}, nil
+	// Drop the download connections so the upload starts on fresh ones rather
+	// than on sockets whose buffers and congestion state the download shaped.
+	client.CloseIdleConnections()
+	var uploadRes SpeedMetrics
+	var uploadErr error
+	switch {
+	case info != nil && !info.Upload:
+		uploadErr = fmt.Errorf("upload: %w", ErrUnsupported)
+	case info != nil && cfg.EchoUpload && !info.EchoUpload:
+		uploadErr = fmt.Errorf("upload echo: %w", ErrUnsupported)
+	default:
+		uploadRes, uploadErr = runUpload(ctx, client, cfg)
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if (cfg.SkipPing || pingErr != nil) && downloadErr != nil && uploadErr != nil {
+		return Result{}, errors.Join(pingErr, downloadErr, uploadErr)
+	}
+	if pingRes.Samples > 0 {
+		if downloadRes.LoadedPing.Avg > 0 {
+			downloadRes.LoadedPingDelta = downloadRes.LoadedPing.Avg - pingRes.Avg
+		}
+		if uploadRes.LoadedPing.Avg > 0 {
+			uploadRes.LoadedPingDelta = uploadRes.LoadedPing.Avg - pingRes.Avg
+		}
+	}
+
+	return Result{
+		Ping:                 pingRes,
+		Download:             downloadRes,
+		Upload:               uploadRes,
+		DownloadHost:         downloadHost,
+		ServerInfo:           info,
+		IPVersion:            ipVersion(),
+		TCP:                  tcp.stats(),
+		SmallTransferPenalty: smallPenalty,
+		RampProfile:          rampProfile,
+		RampKnee:             rampKnee,
+		RampErr:              rampErr,
+		PingErr:              pingErr,
+		DownloadErr:          downloadErr,
+		UploadErr:            uploadErr,
+		Label:                cfg.Label,
+		StartedAt:            startedAt,
+		EndedAt:              time.Now(),
+		Config:               cfg,
+		Meta:                 collectMeta(cfg),
+	}, nil
 }
 
-func normalizeClientConfig(cfg ClientConfig) ClientConfig {
+// maxInfoBytes caps how much of an /info response is read.
+const maxInfoBytes = 64 << 10
+
+// fetchServerInfo asks the server what it supports. A server without /info,
+// like every one that predates it, yields nil and is assumed to support
+// everything, as does one whose answer is not the expected JSON or does not
+// come from an ispeed server, such as a catch-all route answering "{}".
+func fetchServerInfo(ctx context.Context, client *http.Client, cfg ClientConfig) *ServerInfo {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint(cfg, "/info"), nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	var info ServerInfo
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxInfoBytes)).Decode(&info); err != nil {
+		return nil
+	}
+	if !isIspeedServer(resp) && info.Version == "" {
+		return nil
+	}
+	return &info
+}
+
+// Quick is the "just give me numbers fast" entry point: a few pings, a small
+// download and a short upload against baseURL. The result is rough; use
+// RunClientContext with a tuned ClientConfig for careful measurements.
+func Quick(ctx context.Context, baseURL string) (Result, error) {
+	return RunClientContext(ctx, ClientConfig{
+		BaseURL:      baseURL,
+		Duration:     3 * time.Second,
+		Streams:      2,
+		DownloadMB:   8,
+		PingCount:    3,
+		PingInterval: DefaultPingInterval,
+		Timeout:      10 * time.Second,
+	})
+}
+
+// collectMeta describes the machine running the test, unless cfg.OmitMeta
+// asks to keep that private.
+func collectMeta(cfg ClientConfig) Meta {
+	if cfg.OmitMeta {
+		return Meta{}
+	}
+	hostname, _ := os.Hostname()
+	return Meta{OS: runtime.GOOS, Arch: runtime.GOARCH, Hostname: hostname, Version: Version}
+}
+
+// normalizeClientConfig fills unset or invalid fields with defaults. With
+// cfg.Strict it instead reports every such field, so a run only ever uses the
+// parameters it was given.
+func normalizeClientConfig(cfg ClientConfig) (ClientConfig, error) {
+	var problems []error
+	fallback := func(field string) {
+		if cfg.Strict {
+			problems = append(problems, fmt.Errorf("strict: %s is unset or invalid", field))
+		}
+	}
+
 	if cfg.BaseURL == "" {
+		fallback("BaseURL")
 		cfg.BaseURL = DefaultClientBase
 	}
 	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
 	if cfg.Duration <= 0 {
+		fallback("Duration")
 		cfg.Duration = DefaultDuration
 	}
 	if cfg.Streams < 1 {
+		fallback("Streams")
 		cfg.Streams = DefaultStreams
 	}
+	// Zero per-direction streams means "same as Streams", which strict mode
+	// accepts; only a negative count is invalid.
+	if cfg.DownloadStreams < 1 {
+		if cfg.DownloadStreams < 0 {
+			fallback("DownloadStreams")
+		}
+		cfg.DownloadStreams = cfg.Streams
+	}
+	if cfg.UploadStreams < 1 {
+		if cfg.UploadStreams < 0 {
+			fallback("UploadStreams")
+		}
+		cfg.UploadStreams = cfg.Streams
+	}
 	if cfg.ChunkSize < 1024 {
+		fallback("ChunkSize")
 		cfg.ChunkSize = DefaultChunkSize
 	}
-	if cfg.DownloadMB < 1 {
+	if cfg.DownloadMB < 1 && cfg.TotalDownloadMB < 1 {
+		fallback("DownloadMB")
 		cfg.DownloadMB = DefaultDownloadMB
 	}
+	if cfg.SizeJitterPct < 0 || cfg.SizeJitterPct > 90 {
+		fallback("SizeJitterPct")
+		cfg.SizeJitterPct = min(max(cfg.SizeJitterPct, 0), 90)
+	}
 	if cfg.PingCount < 1 {
+		fallback("PingCount")
 		cfg.PingCount = DefaultPingCount
 	}
+	if cfg.WarmupDuration == 0 {
+		fallback("WarmupDuration")
+		cfg.WarmupDuration = DefaultWarmup
+	}
+	cfg.WarmupDuration = max(cfg.WarmupDuration, 0)
+	if cfg.adaptive() {
+		cfg.Duration = cfg.MaxDuration
+		if cfg.MinDuration < 0 || cfg.MinDuration > cfg.MaxDuration {
+			fallback("MinDuration")
+			cfg.MinDuration = min(max(cfg.MinDuration, 0), cfg.MaxDuration)
+		}
+		if cfg.StableCV <= 0 {
+			fallback("StableCV")
+			cfg.StableCV = DefaultStableCV
+		}
+		cfg.DownloadMode = DownloadModeDuration
+	}
+	if cfg.PingInterval < 0 {
+		fallback("PingInterval")
+		cfg.PingInterval = DefaultPingInterval
+	}
+	if cfg.PingRetries == 0 {
+		fallback("PingRetries")
+		cfg.PingRetries = DefaultPingRetries
+	}
+	cfg.PingRetries = max(cfg.PingRetries, 0)
 	if cfg.Timeout <= 0 {
+		fallback("Timeout")
 		cfg.Timeout = DefaultTimeout
 	}
+	cfg.PingMode = strings.ToLower(cfg.PingMode)
+	if cfg.PingMode != PingModeWebSocket {
+		if cfg.PingMode != "" && cfg.PingMode != PingModeHTTP {
+			fallback("PingMode")
+		}
+		cfg.PingMode = PingModeHTTP
+	}
+	cfg.IPVersion = strings.ToLower(cfg.IPVersion)
+	if cfg.IPVersion != IPVersion4 && cfg.IPVersion != IPVersion6 {
+		if cfg.IPVersion != "" && cfg.IPVersion != IPVersionAuto {
+			fallback("IPVersion")
+		}
+		cfg.IPVersion = IPVersionAuto
+	}
+	cfg.DownloadMode = strings.ToLower(cfg.DownloadMode)
+	if cfg.DownloadMode != DownloadModeDuration {
+		if cfg.DownloadMode != "" && cfg.DownloadMode != DownloadModeSize {
+			fallback("DownloadMode")
+		}
+		cfg.DownloadMode = DownloadModeSize
+	}
+	cfg.DownloadMethod = strings.ToUpper(cfg.DownloadMethod)
+	if cfg.DownloadMethod != http.MethodPost {
+		if cfg.DownloadMethod != http.MethodGet {
+			fallback("DownloadMethod")
+		}
+		cfg.DownloadMethod = http.MethodGet
+	}
 
-	return cfg
+	return cfg, errors.Join(problems...)
 }
 
-func reportProgress(cfg ClientConfig, phase string, percent float64, mbps float64, pingMs float64) {
-	if cfg.Progress == nil {
+func reportProgress(cfg ClientConfig, update ProgressUpdate) {
+	if !cfg.hasProgress() {
 		return
 	}
-	if percent < 0 {
-		percent = 0
+	update.Percent = min(max(update.Percent, 0), 100)
+	update.Mbps = max(update.Mbps, 0)
+	update.PingMs = max(update.PingMs, 0)
+	deliverProgress(cfg, update)
+}
+
+// reportFinalProgress emits the 100% update that closes a phase. It is only
+// sent for phases that succeeded and is marked Final so subscribers know not
+// to drop it.
+func reportFinalProgress(cfg ClientConfig, phase string, mbps float64, pingMs float64) {
+	if !cfg.hasProgress() {
+		return
 	}
-	if percent > 100 {
-		percent = 100
+	deliverProgress(cfg, ProgressUpdate{Phase: phase, Percent: 100, Mbps: max(mbps, 0), PingMs: max(pingMs, 0), Final: true})
+}
+
+func deliverProgress(cfg ClientConfig, update ProgressUpdate) {
+	if cfg.Progress != nil {
+		cfg.Progress(update)
+	}
+	for _, sink := range cfg.ProgressSinks {
+		sink(update)
+	}
+}
+
+// progressTick is how often progress is reported and throughput sampled.
+const progressTick = 200 * time.Millisecond
+
+// startProgress calls report every progressTick until the returned stop
+// function is called. stop waits for the ticker goroutine to exit, so no
+// periodic update can land after the caller's final one. With
+// cfg.CollectSamples the same ticker also records the phase's throughput
+// curve from total, which stop hands back.
+func startProgress(cfg ClientConfig, total *int64, since func() time.Duration, report func()) func() []ThroughputSample {
+	if !cfg.hasProgress() && !cfg.CollectSamples {
+		return func() []ThroughputSample { return nil }
 	}
-	if mbps < 0 {
-		mbps = 0
+
+	var samples []ThroughputSample
+	var lastBytes int64
+	var lastElapsed time.Duration
+	record := func() {
+		current, elapsed := atomic.LoadInt64(total), since()
+		if elapsed <= lastElapsed && len(samples) > 0 {
+			// A clock that stood still or went back has no interval to divide
+			// by; the bytes count towards the next sample instead.
+			return
+		}
+		samples = append(samples, ThroughputSample{
+			Elapsed: elapsed,
+			Bytes:   current,
+			Mbps:    bytesToMbps(current-lastBytes, elapsed-lastElapsed),
+		})
+		lastBytes, lastElapsed = current, elapsed
 	}
-	if pingMs < 0 {
-		pingMs = 0
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(progressTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if cfg.CollectSamples {
+					record()
+				}
+				if cfg.hasProgress() {
+					report()
+				}
+			}
+		}
+	}()
+
+	return func() []ThroughputSample {
+		close(done)
+		<-exited
+		// The tail after the last tick usually ends in a partial read, and its
+		// rate would show a dip that is not on the link, so it is dropped. A
+		// phase shorter than a tick still gets its one sample.
+		if cfg.CollectSamples && len(samples) == 0 {
+			record()
+		}
+		return samples
 	}
-	cfg.Progress(ProgressUpdate{Phase: phase, Percent: percent, Mbps: mbps, PingMs: pingMs})
 }
 
-func runPing(client *http.Client, cfg ClientConfig) (PingMetrics, error) {
+// pingRetryBackoff is the wait before the first retry of a failed ping
+// sample; it doubles on each further retry.
+const pingRetryBackoff = 100 * time.Millisecond
+
+// runPing switches cfg to trailing-slash paths for every later phase when the
+// server answers /ping with 404 but /ping/ works, as some routers require.
+func runPing(ctx context.Context, client *http.Client, cfg *ClientConfig) (PingMetrics, error) {
+	ctx, conns := traceConns(ctx, *cfg)
+	ctx, timing := traceTiming(ctx, *cfg)
 	results := make([]time.Duration, 0, cfg.PingCount)
-	url := cfg.BaseURL + "/ping"
+	retransmits := 0
+	var unmarked bool
 
 	for i := 0; i < cfg.PingCount; i++ {
-		start := time.Now()
-		resp, err := client.Get(url)
+		sample, resp, err := pingWithRetry(ctx, client, endpoint(*cfg, "/ping"), cfg.PingRetries, &retransmits)
 		if err != nil {
 			return PingMetrics{}, err
 		}
-
-		_, _ = io.Copy(io.Discard, resp.Body)
-		_ = resp.Body.Close()
-		results = append(results, time.Since(start))
-		reportProgress(cfg, "ping", float64(i+1)/float64(cfg.PingCount)*100, 0, float64(time.Since(start).Milliseconds()))
+		if i == 0 && resp.StatusCode == http.StatusNotFound {
+			retry, slashResp, err := timedGet(ctx, client, cfg.BaseURL+"/ping/")
+			if err == nil && slashResp.StatusCode != http.StatusNotFound {
+				cfg.trailingSlash = true
+				sample, resp = retry, slashResp
+			}
+		}
+		if !successStatus(resp.StatusCode) {
+			return PingMetrics{}, newStatusError("ping", resp, false)
+		}
+		if i == 0 {
+			unmarked = !isIspeedServer(resp)
+		}
+		results = append(results, sample)
+		if i == cfg.PingCount-1 {
+			reportFinalProgress(*cfg, "ping", 0, sample.Seconds()*1000)
+		} else {
+			reportProgress(*cfg, ProgressUpdate{Phase: "ping", Percent: float64(i+1) / float64(cfg.PingCount) * 100, PingMs: sample.Seconds() * 1000})
+		}
 		if i < cfg.PingCount-1 {
-			time.Sleep(150 * time.Millisecond)
+			select {
+			case <-time.After(cfg.PingInterval):
+			case <-ctx.Done():
+				return PingMetrics{}, ctx.Err()
+			}
 		}
 	}
 
 	// No assert :(
 	if len(results) == 0 {
-		return PingMetrics{}, errors.New("ping returned no data")
+		return PingMetrics{}, fmt.Errorf("ping returned %w", ErrNoData)
+	}
+
+	metrics := pingMetrics(results)
+	metrics.Retransmits = retransmits
+	metrics.Unmarked = unmarked
+	metrics.Conns = conns.stats()
+	metrics.Timing = timing.breakdown()
+	return metrics, nil
+}
+
+// pingWithRetry takes one ping sample, retrying failed requests up to retries
+// times with exponential backoff. The first packet after an idle period often
+// times out on mobile links, and one lost sample should not fail the run.
+func pingWithRetry(ctx context.Context, client *http.Client, url string, retries int, retransmits *int) (time.Duration, *http.Response, error) {
+	backoff := pingRetryBackoff
+	for attempt := 0; ; attempt++ {
+		sample, resp, err := timedGet(ctx, client, url)
+		if err == nil || attempt == retries || ctx.Err() != nil {
+			return sample, resp, err
+		}
+		*retransmits++
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// PingOnce times a single /ping round trip to baseURL.
+func PingOnce(ctx context.Context, client *http.Client, baseURL string) (time.Duration, error) {
+	elapsed, _, err := ProbeServer(ctx, client, baseURL)
+	return elapsed, err
+}
+
+// ProbeServer is PingOnce that also reports whether the response carried
+// MarkerHeader, i.e. whether an ispeed server answered. Like runPing it tries
+// /ping/ when /ping is not found, and any other non-2xx answer is an error.
+func ProbeServer(ctx context.Context, client *http.Client, baseURL string) (time.Duration, bool, error) {
+	url := strings.TrimRight(baseURL, "/") + "/ping"
+	elapsed, resp, err := timedGet(ctx, client, url)
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		retry, slashResp, err := timedGet(ctx, client, url+"/")
+		if err == nil && slashResp.StatusCode != http.StatusNotFound {
+			elapsed, resp = retry, slashResp
+		}
+	}
+	if !successStatus(resp.StatusCode) {
+		return 0, false, newStatusError("ping", resp, false)
+	}
+	return elapsed, isIspeedServer(resp), nil
+}
+
+// isIspeedServer reports whether resp came from an ispeed server, which tags
+// every response with MarkerHeader, rather than from a captive portal or an
+// unrelated service on the same path.
+func isIspeedServer(resp *http.Response) bool {
+	return resp.Header.Get(MarkerHeader) != ""
+}
+
+// FetchLoad asks the server at baseURL how busy it is. Servers without a
+// /load endpoint, such as older deployments, return an error.
+func FetchLoad(ctx context.Context, client *http.Client, baseURL string) (LoadReport, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+"/load", nil)
+	if err != nil {
+		return LoadReport{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return LoadReport{}, &ConnError{Op: "load", Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return LoadReport{}, newStatusError("load", resp, false)
 	}
 
-	slices.Sort(results)
-	min := results[0]
-	avg := avgDuration(results)
-	p95 := percentileDuration(results, 0.95)
+	var report LoadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return LoadReport{}, fmt.Errorf("load: %w", err)
+	}
+	return report, nil
+}
+
+// statusSnippetBytes is how much of an error response body StatusError keeps.
+const statusSnippetBytes = 200
+
+// ErrNoData is wrapped by a phase that finished without transferring anything.
+var ErrNoData = errors.New("no data")
+
+// ErrUnsupported is wrapped by a phase the server said in /info it does not
+// offer, which is then skipped rather than attempted.
+var ErrUnsupported = errors.New("not supported by the server")
+
+// ConnError is returned when a request got no response at all: the connection
+// was refused or timed out, DNS or the TLS handshake failed. Op is the phase,
+// e.g. "ping" or "download", and Err the underlying *url.Error, so errors.Is
+// still sees a context cancellation through it.
+type ConnError struct {
+	Op  string
+	Err error
+}
 
-	return PingMetrics{Min: min, Avg: avg, P95: p95}, nil
+func (e *ConnError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the server answers a ping or transfer with a
+// non-2xx status, so the request must not count as a measurement. A wrong
+// -url usually shows up as one of these rather than as bogus numbers. Op is
+// the phase and Code the numeric form of Status.
+type StatusError struct {
+	Op     string
+	URL    string
+	Code   int
+	Status string
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s endpoint %s returned %s", e.Op, e.URL, e.Status)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// newStatusError builds a StatusError for resp, including the start of the
+// body when it has not been read yet.
+func newStatusError(op string, resp *http.Response, readBody bool) *StatusError {
+	statusErr := &StatusError{Op: op, URL: resp.Request.URL.String(), Code: resp.StatusCode, Status: resp.Status}
+	if readBody {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, statusSnippetBytes))
+		statusErr.Body = strings.TrimSpace(string(snippet))
+	}
+	return statusErr
+}
+
+func successStatus(code int) bool {
+	return code >= 200 && code <= 299
+}
+
+// timedGet times a GET of url including draining the body. The returned
+// response is already closed and only good for its status and headers.
+func timedGet(ctx context.Context, client *http.Client, url string) (time.Duration, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, &ConnError{Op: "ping", Err: err}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return time.Since(start), resp, nil
+}
+
+// endpoint joins cfg.BaseURL and path in the form the server accepted.
+func endpoint(cfg ClientConfig, path string) string {
+	if cfg.trailingSlash {
+		return cfg.BaseURL + path + "/"
+	}
+	return cfg.BaseURL + path
+}
+
+func pingMetrics(samples []time.Duration) PingMetrics {
+	if len(samples) == 0 {
+		return PingMetrics{}
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	min := sorted[0]
+	avg := avgDuration(sorted)
+	p95 := percentileDuration(sorted, 0.95)
+
+	return PingMetrics{
+		Min:     min,
+		Avg:     avg,
+		Median:  percentileDuration(sorted, 0.5),
+		P95:     p95,
+		Jitter:  jitter(samples),
+		Samples: len(sorted),
+		All:     slices.Clone(samples),
+	}
+}
+
+// jitter is the mean absolute difference between consecutive samples. It
+// needs the samples in the order they were taken; sorting would hide it.
+func jitter(samples []time.Duration) time.Duration {
+	if len(samples) < 2 {
+		return 0
+	}
+	var total time.Duration
+	for i := 1; i < len(samples); i++ {
+		diff := samples[i] - samples[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return total / time.Duration(len(samples)-1)
+}
+
+const loadedPingInterval = 250 * time.Millisecond
+
+// startLoadedPing samples /ping in the background while a throughput phase
+// saturates the link. The returned function stops sampling and summarizes
+// what was collected.
+func startLoadedPing(ctx context.Context, client *http.Client, cfg ClientConfig) func() PingMetrics {
+	if !cfg.Bufferbloat {
+		return func() PingMetrics { return PingMetrics{} }
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var samples []time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(loadedPingInterval)
+		defer ticker.Stop()
+		for {
+			if sample, _, err := timedGet(ctx, client, endpoint(cfg, "/ping")); err == nil {
+				samples = append(samples, sample)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() PingMetrics {
+		cancel()
+		<-done
+		return pingMetrics(samples)
+	}
 }
 
 func setRunErr(errOnce *sync.Once, runErr *error, err error) {
@@ -125,168 +727,653 @@ func setRunErr(errOnce *sync.Once, runErr *error, err error) {
 	})
 }
 
-func runDownload(client *http.Client, cfg ClientConfig) (SpeedMetrics, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Duration+5*time.Second)
+// requestBytes is the size of a single transfer. TotalDownloadMB is a budget
+// for the whole phase, split across streams or requests; DownloadMB is per
+// transfer.
+func requestBytes(cfg ClientConfig) int64 {
+	if cfg.TotalDownloadMB > 0 {
+		parts := cfg.DownloadStreams
+		if cfg.RequestCount > 0 {
+			parts = cfg.RequestCount
+		}
+		return max(int64(cfg.TotalDownloadMB)*1024*1024/int64(parts), 1)
+	}
+	return int64(cfg.DownloadMB) * 1024 * 1024
+}
+
+// smallTransferSizes all fit in a typical initial congestion window, so on a
+// healthy path each should take about one round trip regardless of size.
+var smallTransferSizes = []int64{512, 1400, 1600, 4096, 12288}
+
+const smallTransferRepeats = 3
+
+// runSmallTransferProbe downloads a few tiny bodies and returns how much the
+// slowest size took beyond a bare ping round trip. A large value hints at
+// fragmentation or buffering somewhere on the path.
+func runSmallTransferProbe(ctx context.Context, client *http.Client, cfg ClientConfig, pingMin time.Duration) (time.Duration, error) {
+	var worst time.Duration
+	for _, size := range smallTransferSizes {
+		best := time.Duration(math.MaxInt64)
+		for range smallTransferRepeats {
+			req, err := newDownloadRequest(ctx, cfg, size)
+			if err != nil {
+				return 0, err
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				return 0, &ConnError{Op: "download", Err: err}
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if !successStatus(resp.StatusCode) {
+				return 0, newStatusError("download", resp, false)
+			}
+			best = min(best, time.Since(start))
+		}
+		worst = max(worst, best)
+	}
+	return max(worst-pingMin, 0), nil
+}
+
+type connCounter struct {
+	reused int64
+	fresh  int64
+}
+
+func (c *connCounter) stats() ConnStats {
+	if c == nil {
+		return ConnStats{}
+	}
+	return ConnStats{Reused: int(atomic.LoadInt64(&c.reused)), New: int(atomic.LoadInt64(&c.fresh))}
+}
+
+// traceConns counts reused and newly dialed connections for requests made
+// with the returned context. Without cfg.Trace it returns ctx unchanged and a
+// nil counter, which reports zero.
+func traceConns(ctx context.Context, cfg ClientConfig) (context.Context, *connCounter) {
+	if !cfg.Trace {
+		return ctx, nil
+	}
+	counter := &connCounter{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&counter.reused, 1)
+			} else {
+				atomic.AddInt64(&counter.fresh, 1)
+			}
+		},
+	}), counter
+}
+
+// timingRecorder collects the stage timestamps of the first request made with
+// its context. Dial callbacks can arrive from other goroutines, hence the lock.
+type timingRecorder struct {
+	mu                  sync.Mutex
+	done                bool
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	wrote, firstByte    time.Time
+}
+
+// traceTiming records the DNS, connect, TLS and first-byte times of the first
+// request made with the returned context. Without cfg.ConnTrace it returns ctx
+// unchanged and a nil recorder, which reports zero.
+func traceTiming(ctx context.Context, cfg ClientConfig) (context.Context, *timingRecorder) {
+	if !cfg.ConnTrace {
+		return ctx, nil
+	}
+	rec := &timingRecorder{}
+	mark := func(t *time.Time) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if !rec.done && t.IsZero() {
+			*t = time.Now()
+		}
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { mark(&rec.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { mark(&rec.dnsDone) },
+		ConnectStart:      func(string, string) { mark(&rec.connStart) },
+		ConnectDone:       func(string, string, error) { mark(&rec.connDone) },
+		TLSHandshakeStart: func() { mark(&rec.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { mark(&rec.tlsDone) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { mark(&rec.wrote) },
+		GotFirstResponseByte: func() {
+			mark(&rec.firstByte)
+			rec.mu.Lock()
+			rec.done = true
+			rec.mu.Unlock()
+		},
+	}), rec
+}
+
+func (r *timingRecorder) breakdown() TimingBreakdown {
+	if r == nil {
+		return TimingBreakdown{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	span := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return end.Sub(start)
+	}
+	return TimingBreakdown{
+		DNS:     span(r.dnsStart, r.dnsDone),
+		Connect: span(r.connStart, r.connDone),
+		TLS:     span(r.tlsStart, r.tlsDone),
+		TTFB:    span(r.wrote, r.firstByte),
+	}
+}
+
+// phaseClock is the start of a phase's measurement window. It can move
+// forward once, from another goroutine, when the first response byte arrives.
+type phaseClock struct {
+	start atomic.Pointer[time.Time]
+	once  sync.Once
+}
+
+func newPhaseClock() *phaseClock {
+	c := &phaseClock{}
+	now := time.Now()
+	c.start.Store(&now)
+	return c
+}
+
+func (c *phaseClock) since() time.Duration {
+	return time.Since(*c.start.Load())
+}
+
+// startAtFirstByte restarts the clock when the first response of the phase
+// starts arriving, so slow DNS or connection setup is not counted as transfer
+// time.
+func (c *phaseClock) startAtFirstByte(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			c.once.Do(func() {
+				now := time.Now()
+				c.start.Store(&now)
+			})
+		},
+	})
+}
+
+// jitterSize returns size moved by a random amount of up to pct percent either
+// way, so streams of one phase do not all finish at the same moment.
+func jitterSize(size int64, pct float64) int64 {
+	if pct <= 0 {
+		return size
+	}
+	spread := (mathrand.Float64()*2 - 1) * pct / 100
+	return max(int64(float64(size)*(1+spread)), 1)
+}
+
+func phaseContext(parent context.Context, cfg ClientConfig) (context.Context, context.CancelFunc) {
+	if cfg.RequestCount > 0 {
+		// Fixed-work runs must not be cut short; each request is still bounded by cfg.Timeout.
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, cfg.Duration+5*time.Second)
+}
+
+// runDownload also returns the host that served the first download, which
+// differs from cfg.BaseURL when the server redirects to another node.
+func runDownload(ctx context.Context, client *http.Client, cfg ClientConfig) (SpeedMetrics, string, error) {
+	ctx, conns := traceConns(ctx, cfg)
+	ctx, cancel := phaseContext(ctx, cfg)
 	defer cancel()
 
 	var totalBytes int64
+	var issued int64
+	var requests int64
 	var runErr error
 	var errOnce sync.Once
+	var protocol string
+	var host string
+	var protocolOnce sync.Once
 	wg := sync.WaitGroup{}
-	start := time.Now()
+	clock := newPhaseClock()
+	if cfg.ClockFromFirstByte {
+		ctx = clock.startAtFirstByte(ctx)
+	}
 
-	perStreamBytes := int64(cfg.DownloadMB) * 1024 * 1024
-	targetBytes := perStreamBytes * int64(cfg.Streams)
-	var progressDone chan struct{}
-	if cfg.Progress != nil {
-		progressDone = make(chan struct{})
-		progressStart := start
-		go func() {
-			ticker := time.NewTicker(200 * time.Millisecond)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-progressDone:
-					return
-				case <-ticker.C:
-					current := atomic.LoadInt64(&totalBytes)
-					elapsed := time.Since(progressStart)
-					reportProgress(cfg, "download", percentDone(current, targetBytes), bytesToMbps(current, elapsed), 0)
-				}
-			}
-		}()
+	perStreamBytes := requestBytes(cfg)
+	if cfg.maxDownloadBytes > 0 {
+		// The server would silently send less, leaving the target unreachable.
+		perStreamBytes = min(perStreamBytes, cfg.maxDownloadBytes)
 	}
+	targetBytes := perStreamBytes * int64(cfg.DownloadStreams)
+	if cfg.RequestCount > 0 {
+		targetBytes = perStreamBytes * int64(cfg.RequestCount)
+	}
+	byDuration := cfg.DownloadMode == DownloadModeDuration && cfg.RequestCount == 0
+	// In duration mode the streams run on a deadline ctx, whose expiry ends the
+	// phase normally rather than failing it.
+	streamCtx := ctx
+	stopStreams := context.CancelFunc(func() {})
+	if byDuration {
+		streamCtx, stopStreams = context.WithTimeout(ctx, cfg.Duration)
+		defer stopStreams()
+	}
+	warm := startWarmup(cfg.WarmupDuration, &totalBytes, clock.since)
+	stopWatch := watchStability(ctx, cfg, &totalBytes, clock.since, stopStreams)
+	stopProgress := startProgress(cfg, &totalBytes, clock.since, func() {
+		current := atomic.LoadInt64(&totalBytes)
+		target := atomic.LoadInt64(&targetBytes)
+		elapsed := clock.since()
+		percent := percentDone(current, target)
+		if byDuration {
+			// The amount is open-ended, so there is no total to report.
+			percent, target = percentElapsed(elapsed, cfg.Duration), 0
+		}
+		reportProgress(cfg, ProgressUpdate{
+			Phase:      "download",
+			Percent:    percent,
+			Mbps:       bytesToMbps(current, elapsed),
+			Bytes:      current,
+			TotalBytes: target,
+			ETA:        estimateETA(current, target, elapsed, cfg.Duration),
+			Warmup:     warm.active(),
+		})
+	})
 
-	for i := 0; i < cfg.Streams; i++ {
+	stopLoadedPing := startLoadedPing(ctx, client, cfg)
+	streams := make([]streamStat, cfg.DownloadStreams)
+	for i := 0; i < cfg.DownloadStreams; i++ {
 		wg.Go(func() {
-			url := fmt.Sprintf("%s/download?size=%d", cfg.BaseURL, perStreamBytes)
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-			if err != nil {
-				setRunErr(&errOnce, &runErr, err)
-				return
-			}
-
-			resp, err := client.Do(req)
-			if err != nil {
-				setRunErr(&errOnce, &runErr, err)
-				return
-			}
+			streamStart := time.Now()
+			defer func() {
+				streams[i].duration = time.Since(streamStart)
+			}()
 
 			buf := make([]byte, cfg.ChunkSize)
 			for {
-				read, err := resp.Body.Read(buf)
-				if read > 0 {
-					atomic.AddInt64(&totalBytes, int64(read))
+				if cfg.RequestCount > 0 && atomic.AddInt64(&issued, 1) > int64(cfg.RequestCount) {
+					return
 				}
-				if err != nil {
-					if !errors.Is(err, io.EOF) {
-						setRunErr(&errOnce, &runErr, err)
+				size := jitterSize(perStreamBytes, cfg.SizeJitterPct)
+				atomic.AddInt64(&targetBytes, size-perStreamBytes)
+				info, err := downloadOnce(streamCtx, client, cfg, size, buf, &totalBytes, &targetBytes)
+				streams[i].bytes += info.bytes
+				// A request cut off by the deadline never got the trailer and
+				// has no rate to report, so only completed ones are averaged.
+				if info.sentBps > 0 {
+					streams[i].sentBps += info.sentBps
+					streams[i].sentReports++
+				}
+				if info.protocol != "" {
+					protocolOnce.Do(func() {
+						protocol = info.protocol
+						host = info.host
+					})
+				}
+				// In duration mode the stream deadline ends the phase; otherwise a
+				// slow link can run into the phase deadline before the requested
+				// size arrives. Either way what arrived still counts.
+				if (byDuration && streamCtx.Err() != nil) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					if info.bytes > 0 {
+						atomic.AddInt64(&requests, 1)
 					}
-					break
+					return
+				}
+				if err != nil {
+					setRunErr(&errOnce, &runErr, err)
+					return
+				}
+				atomic.AddInt64(&requests, 1)
+				if cfg.RequestCount == 0 && !byDuration {
+					return
 				}
 			}
-			_ = resp.Body.Close()
 		})
 	}
 
 	wg.Wait()
-	elapsed := time.Since(start)
-
-	if cfg.Progress != nil {
-		if progressDone != nil {
-			close(progressDone)
-		}
-		reportProgress(cfg, "download", 100, bytesToMbps(totalBytes, elapsed), 0)
-	}
+	elapsed := clock.since()
+	settled := stopWatch()
+	samples := stopProgress()
+	loadedPing := stopLoadedPing()
 
 	if runErr != nil {
-		return SpeedMetrics{}, runErr
+		return SpeedMetrics{}, "", runErr
 	}
 	if totalBytes == 0 {
-		return SpeedMetrics{}, errors.New("download returned no data")
+		return SpeedMetrics{}, "", fmt.Errorf("download returned %w", ErrNoData)
+	}
+	measured, window, warmup := warm.measured(totalBytes, elapsed)
+	reportFinalProgress(cfg, "download", bytesToMbps(measured, window), 0)
+
+	mbps := bytesToMbps(measured, window)
+
+	streamMbps, stdDev := streamRates(streams)
+
+	return SpeedMetrics{
+		Mbps:               mbps,
+		StreamSumMbps:      sumStreamMbps(streams),
+		StreamMbps:         streamMbps,
+		StdDevMbps:         stdDev,
+		Bytes:              measured,
+		Duration:           window,
+		Warmup:             warmup,
+		Requests:           int(requests),
+		Streams:            len(streams),
+		Protocol:           protocol,
+		ServerReportedMbps: serverReportedMbps(streams),
+		LoadedPing:         loadedPing,
+		Conns:              conns.stats(),
+		Settled:            settled,
+		Samples:            samples,
+	}, host, nil
+}
+
+type downloadInfo struct {
+	bytes    int64
+	protocol string
+	host     string
+	sentBps  float64
+}
+
+func negotiatedProtocol(resp *http.Response) string {
+	if resp.TLS != nil && resp.TLS.NegotiatedProtocol != "" {
+		return resp.TLS.NegotiatedProtocol
+	}
+	if resp.ProtoMajor == 2 {
+		return "h2"
+	}
+	return "http/1.1"
+}
+
+func newDownloadRequest(ctx context.Context, cfg ClientConfig, size int64) (*http.Request, error) {
+	url := fmt.Sprintf("%s?size=%d", endpoint(cfg, "/download"), size)
+	if cfg.DownloadMethod != http.MethodPost {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	}
+	body := strings.ReplaceAll(cfg.DownloadBody, "{size}", strconv.FormatInt(size, 10))
+	return http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+}
+
+func serverSentBps(resp *http.Response) float64 {
+	bps, err := strconv.ParseFloat(resp.Trailer.Get(SentRateTrailer), 64)
+	if err != nil || bps < 0 {
+		return 0
 	}
+	return bps
+}
 
-	mbps := bytesToMbps(totalBytes, elapsed)
+// downloadOnce fetches size bytes into buf, adding them to total. When the
+// server sends less than asked for, the shortfall is taken off target so
+// progress can still reach 100%.
+func downloadOnce(ctx context.Context, client *http.Client, cfg ClientConfig, size int64, buf []byte, total *int64, target *int64) (downloadInfo, error) {
+	req, err := newDownloadRequest(ctx, cfg, size)
+	if err != nil {
+		return downloadInfo{}, err
+	}
+	if cfg.ServerRate {
+		req.Header.Set("TE", "trailers")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return downloadInfo{}, &ConnError{Op: "download", Err: err}
+	}
+	defer resp.Body.Close()
+	if !successStatus(resp.StatusCode) {
+		return downloadInfo{}, newStatusError("download", resp, true)
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength < size {
+		atomic.AddInt64(target, resp.ContentLength-size)
+		size = resp.ContentLength
+	}
 
-	return SpeedMetrics{Mbps: mbps, Bytes: totalBytes, Duration: elapsed}, nil
+	// resp.Request is the last request of any redirect chain.
+	info := downloadInfo{protocol: negotiatedProtocol(resp), host: resp.Request.URL.Host}
+	body := &countingReader{r: resp.Body, total: total}
+	if cfg.SimpleCopy {
+		info.bytes, err = io.Copy(io.Discard, body)
+	} else {
+		info.bytes, err = readAll(body, buf)
+	}
+	if err != nil {
+		return info, err
+	}
+	if info.bytes < size {
+		atomic.AddInt64(target, info.bytes-size)
+	}
+	info.sentBps = serverSentBps(resp)
+	return info, nil
+}
+
+// readAll drains r with reads of len(buf), like io.Copy but with the read size
+// under the caller's control via cfg.ChunkSize.
+func readAll(r io.Reader, buf []byte) (int64, error) {
+	var n int64
+	for {
+		read, err := r.Read(buf)
+		n += int64(read)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
 }
 
-func runUpload(client *http.Client, cfg ClientConfig) (SpeedMetrics, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Duration+5*time.Second)
+func runUpload(ctx context.Context, client *http.Client, cfg ClientConfig) (SpeedMetrics, error) {
+	ctx, conns := traceConns(ctx, cfg)
+	ctx, cancel := phaseContext(ctx, cfg)
 	defer cancel()
 
 	var totalBytes int64
+	var echoedBytes int64
+	var rejected int64
+	var issued int64
+	var requests int64
 	var runErr error
 	var errOnce sync.Once
 	wg := sync.WaitGroup{}
 	start := time.Now()
 
-	var progressDone chan struct{}
-	if cfg.Progress != nil {
-		progressDone = make(chan struct{})
-		progressStart := start
-		go func() {
-			ticker := time.NewTicker(200 * time.Millisecond)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-progressDone:
-					return
-				case <-ticker.C:
-					current := atomic.LoadInt64(&totalBytes)
-					elapsed := time.Since(progressStart)
-					reportProgress(cfg, "upload", percentElapsed(elapsed, cfg.Duration), bytesToMbps(current, elapsed), 0)
+	static := cfg.UploadData
+	if len(static) == 0 && cfg.StaticUpload {
+		static = make([]byte, cfg.ChunkSize)
+		if _, err := rand.Read(static); err != nil {
+			return SpeedMetrics{}, err
+		}
+	}
 
-				}
-			}
-		}()
+	var perRequestBytes int64
+	var targetBytes int64
+	if cfg.RequestCount > 0 {
+		perRequestBytes = requestBytes(cfg)
+		targetBytes = perRequestBytes * int64(cfg.RequestCount)
+	} else if cfg.UploadMB > 0 {
+		perRequestBytes = int64(cfg.UploadMB) * 1024 * 1024
+		targetBytes = perRequestBytes * int64(cfg.UploadStreams)
+	}
+
+	// A duration-bound upload sends until cfg.Duration runs out. When the
+	// server reads only so much of one request, each stream sends requests of
+	// that size back to back instead of one that the server would cut off.
+	durationBound := perRequestBytes == 0
+	requestLimit := perRequestBytes
+	streamCtx, stopStreams := context.WithCancel(ctx)
+	if durationBound {
+		requestLimit = cfg.maxUploadBytes
+		streamCtx, stopStreams = context.WithTimeout(ctx, cfg.Duration)
 	}
+	defer stopStreams()
 
-	for i := 0; i < cfg.Streams; i++ {
+	since := func() time.Duration { return time.Since(start) }
+	warm := startWarmup(cfg.WarmupDuration, &totalBytes, since)
+	// Only duration-bound uploads can settle early; a fixed amount runs to the end.
+	stopWatch := func() bool { return false }
+	if durationBound {
+		stopWatch = watchStability(ctx, cfg, &totalBytes, since, stopStreams)
+	}
+	stopProgress := startProgress(cfg, &totalBytes, since, func() {
+		current := atomic.LoadInt64(&totalBytes)
+		elapsed := time.Since(start)
+		percent := percentElapsed(elapsed, cfg.Duration)
+		if targetBytes > 0 {
+			percent = percentDone(current, targetBytes)
+		}
+		reportProgress(cfg, ProgressUpdate{
+			Phase:      "upload",
+			Percent:    percent,
+			Mbps:       bytesToMbps(current, elapsed),
+			Bytes:      current,
+			TotalBytes: targetBytes,
+			ETA:        estimateETA(current, targetBytes, elapsed, cfg.Duration),
+			Warmup:     warm.active(),
+		})
+	})
+
+	stopLoadedPing := startLoadedPing(ctx, client, cfg)
+	streams := make([]streamStat, cfg.UploadStreams)
+	for i := 0; i < cfg.UploadStreams; i++ {
 		wg.Go(func() {
-			uploadCtx, cancelUpload := context.WithTimeout(ctx, cfg.Duration)
-			defer cancelUpload()
+			streamStart := time.Now()
+			defer func() {
+				streams[i].duration = time.Since(streamStart)
+			}()
 
-			reader := &timedReader{ctx: uploadCtx, chunkSize: cfg.ChunkSize, total: &totalBytes}
-			req, err := http.NewRequestWithContext(uploadCtx, http.MethodPost, cfg.BaseURL+"/upload", reader)
-			if err != nil {
-				setRunErr(&errOnce, &runErr, err)
-				return
-			}
-			req.Header.Set("Content-Type", "application/octet-stream")
-			resp, err := client.Do(req)
-			if err != nil {
-				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			for {
+				if cfg.RequestCount > 0 && atomic.AddInt64(&issued, 1) > int64(cfg.RequestCount) {
+					return
+				}
+				sent, err := uploadOnce(streamCtx, client, cfg, requestLimit, static, &totalBytes, &echoedBytes)
+				streams[i].bytes += sent
+				// As with the download, a slow link can run into the phase
+				// deadline before UploadMB is sent; what went out still counts.
+				// A duration-bound stream ends the same way once its time is up.
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) || (durationBound && streamCtx.Err() != nil) {
+					if sent > 0 {
+						atomic.AddInt64(&requests, 1)
+					}
+					return
+				}
+				var statusErr *StatusError
+				switch {
+				case errors.As(err, &statusErr) && cfg.PartialOK:
+					atomic.AddInt64(&rejected, 1)
+				case err != nil:
+					setRunErr(&errOnce, &runErr, err)
+					return
+				default:
+					atomic.AddInt64(&requests, 1)
+				}
+				if cfg.RequestCount == 0 && !(durationBound && requestLimit > 0) {
 					return
 				}
-				setRunErr(&errOnce, &runErr, err)
-				return
 			}
-			_, _ = io.Copy(io.Discard, resp.Body)
-			_ = resp.Body.Close()
 		})
 	}
 
 	wg.Wait()
 	elapsed := time.Since(start)
-
-	if cfg.Progress != nil {
-		if progressDone != nil {
-			close(progressDone)
-		}
-		reportProgress(cfg, "upload", 100, bytesToMbps(totalBytes, elapsed), 0)
-	}
+	settled := stopWatch()
+	samples := stopProgress()
+	loadedPing := stopLoadedPing()
 
 	if runErr != nil {
 		return SpeedMetrics{}, runErr
 	}
 	if totalBytes == 0 {
-		return SpeedMetrics{}, errors.New("upload sent no data")
+		return SpeedMetrics{}, fmt.Errorf("upload sent %w", ErrNoData)
+	}
+	measured, window, warmup := warm.measured(totalBytes, elapsed)
+	reportFinalProgress(cfg, "upload", bytesToMbps(measured, window), 0)
+
+	mbps := bytesToMbps(measured, window)
+	var echoMbps float64
+	if cfg.EchoUpload {
+		// The echo is not split at the warmup, so compare it over the whole phase.
+		echoMbps = min(bytesToMbps(totalBytes, elapsed), bytesToMbps(echoedBytes, elapsed))
+	}
+	streamMbps, stdDev := streamRates(streams)
+
+	return SpeedMetrics{
+		Mbps:          mbps,
+		StreamSumMbps: sumStreamMbps(streams),
+		StreamMbps:    streamMbps,
+		StdDevMbps:    stdDev,
+		Bytes:         measured,
+		Duration:      window,
+		Warmup:        warmup,
+		Requests:      int(requests),
+		Streams:       len(streams),
+		StaticPayload: len(static) > 0,
+		LoadedPing:    loadedPing,
+		EchoBytes:     echoedBytes,
+		EchoMbps:      echoMbps,
+		Rejected:      int(rejected),
+		Conns:         conns.stats(),
+		Settled:       settled,
+		Samples:       samples,
+	}, nil
+}
+
+// uploadOnce sends a single upload request. With limit zero the body is
+// generated until ctx is done, otherwise exactly limit bytes are sent.
+// A non-empty static buffer is sent repeatedly instead of fresh random data.
+func uploadOnce(ctx context.Context, client *http.Client, cfg ClientConfig, limit int64, static []byte, total *int64, echoed *int64) (int64, error) {
+	reader := &timedReader{ctx: ctx, chunkSize: cfg.ChunkSize, limit: limit, static: static, total: total, closed: make(chan struct{})}
+	// The transport can go on sending the body after Do returns, as it does
+	// while an echo streams back, so wait until every byte it sent is counted.
+	defer func() { <-reader.closed }()
+	if len(static) == 0 {
+		random, err := uploadRandom(cfg.Seed)
+		if err != nil {
+			return 0, err
+		}
+		reader.random = random
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint(cfg, "/upload"), reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		if limit == 0 && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+			return reader.bytes(), nil
+		}
+		return reader.bytes(), &ConnError{Op: "upload", Err: err}
+	}
+	defer resp.Body.Close()
+	if !successStatus(resp.StatusCode) {
+		// The bytes went out, but the server did not accept them.
+		return reader.bytes(), newStatusError("upload", resp, true)
+	}
+	if !cfg.EchoUpload {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return reader.bytes(), nil
+	}
+
+	// The echo streams back while the body is still being sent, so this read
+	// runs alongside the transport writing the request.
+	_, err = io.Copy(io.Discard, &countingReader{r: resp.Body, total: echoed})
+	if err != nil && !(limit == 0 && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled))) {
+		return reader.bytes(), err
 	}
+	return reader.bytes(), nil
+}
 
-	mbps := bytesToMbps(totalBytes, elapsed)
+type countingReader struct {
+	r     io.Reader
+	total *int64
+}
 
-	return SpeedMetrics{Mbps: mbps, Bytes: totalBytes, Duration: elapsed}, nil
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.total, int64(n))
+	return n, err
 }
 
 func avgDuration(items []time.Duration) time.Duration {
@@ -319,10 +1406,117 @@ func percentileDuration(items []time.Duration, percentile float64) time.Duration
 	return items[index]
 }
 
+// warmupMark records how far a phase had got when its warmup ended, so the
+// slow-start ramp can be left out of the rate.
+type warmupMark struct {
+	timer *time.Timer
+	mu    sync.Mutex
+	done  bool
+	bytes int64
+	at    time.Duration
+}
+
+// startWarmup snapshots *total and since() once d has passed. A d of zero or
+// less disables the warmup.
+func startWarmup(d time.Duration, total *int64, since func() time.Duration) *warmupMark {
+	mark := &warmupMark{}
+	if d <= 0 {
+		mark.done = true
+		return mark
+	}
+	mark.timer = time.AfterFunc(d, func() {
+		mark.mu.Lock()
+		defer mark.mu.Unlock()
+		mark.bytes = atomic.LoadInt64(total)
+		mark.at = since()
+		mark.done = true
+	})
+	return mark
+}
+
+func (w *warmupMark) active() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.done
+}
+
+// measured returns the bytes and time to compute the rate from, and how much
+// time was excluded. A phase that did not run at least twice the warmup, or
+// moved no data after it, is measured whole: a sliver after the warmup says
+// less than the whole phase does.
+func (w *warmupMark) measured(total int64, elapsed time.Duration) (int64, time.Duration, time.Duration) {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.at <= 0 || elapsed-w.at < w.at || total <= w.bytes {
+		return total, elapsed, 0
+	}
+	return total - w.bytes, elapsed - w.at, w.at
+}
+
+type streamStat struct {
+	bytes    int64
+	duration time.Duration
+	// sentBps adds up the sending rates the server reported for sentReports
+	// of the stream's requests.
+	sentBps     float64
+	sentReports int
+}
+
+// serverReportedMbps sums each stream's average server-reported sending rate.
+func serverReportedMbps(streams []streamStat) float64 {
+	var bps float64
+	for _, stream := range streams {
+		if stream.sentReports > 0 {
+			bps += stream.sentBps / float64(stream.sentReports)
+		}
+	}
+	return bps / 1_000_000
+}
+
+// streamRates returns each stream's rate over its own lifetime and the
+// population standard deviation of those rates.
+func streamRates(streams []streamStat) ([]float64, float64) {
+	rates := make([]float64, len(streams))
+	var mean float64
+	for i, stream := range streams {
+		rates[i] = bytesToMbps(stream.bytes, stream.duration)
+		mean += rates[i]
+	}
+	if len(rates) == 0 {
+		return rates, 0
+	}
+	mean /= float64(len(rates))
+	var variance float64
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	return rates, math.Sqrt(variance / float64(len(rates)))
+}
+
+// sumStreamMbps adds up each stream's rate over its own lifetime, so a stream
+// that finished early is not diluted by the wall-clock time of the slowest one.
+func sumStreamMbps(streams []streamStat) float64 {
+	var total float64
+	for _, stream := range streams {
+		total += bytesToMbps(stream.bytes, stream.duration)
+	}
+	return total
+}
+
+// minRateDuration is the floor applied before dividing by a duration. Every
+// duration here comes from time.Since on a monotonic reading, so wall-clock
+// steps cannot make it negative, but a near-zero value would still explode the
+// rate.
+const minRateDuration = time.Millisecond
+
 func bytesToMbps(bytes int64, duration time.Duration) float64 {
-	if duration <= 0 {
+	if bytes <= 0 {
 		return 0
 	}
+	duration = max(duration, minRateDuration)
 	bits := float64(bytes) * 8
 	return bits / duration.Seconds() / 1_000_000
 }
@@ -341,6 +1535,19 @@ func percentDone(current int64, total int64) float64 {
 	return percent
 }
 
+// estimateETA extrapolates the rate so far over the bytes still to come, or
+// counts down the duration when total is zero. It is zero until the first
+// bytes arrive, since there is no rate to go on yet.
+func estimateETA(current int64, total int64, elapsed time.Duration, duration time.Duration) time.Duration {
+	if total <= 0 {
+		return max(duration-elapsed, 0)
+	}
+	if current <= 0 || elapsed <= 0 || current >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(total-current) / float64(current))
+}
+
 func percentElapsed(elapsed time.Duration, target time.Duration) float64 {
 	if target <= 0 {
 		return 0
@@ -358,8 +1565,23 @@ func percentElapsed(elapsed time.Duration, target time.Duration) float64 {
 type timedReader struct {
 	ctx       context.Context
 	chunkSize int
-	count     int64
-	total     *int64
+	limit     int64
+	static    []byte
+	// random generates the payload when static is empty.
+	random *mathrand.ChaCha8
+	offset int
+	count  int64
+	total  *int64
+	// closed is closed once the transport is done with the body.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Close tells uploadOnce the transport has stopped reading, which with an
+// echo can happen after the response has already been returned.
+func (t *timedReader) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
 }
 
 func (t *timedReader) Read(p []byte) (int, error) {
@@ -370,10 +1592,24 @@ func (t *timedReader) Read(p []byte) (int, error) {
 	if len(p) > t.chunkSize {
 		p = p[:t.chunkSize]
 	}
+	if t.limit > 0 {
+		remaining := t.limit - atomic.LoadInt64(&t.count)
+		if remaining <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
 
-	_, err := rand.Read(p)
-	if err != nil {
-		return 0, err
+	if len(t.static) > 0 {
+		for n := 0; n < len(p); {
+			copied := copy(p[n:], t.static[t.offset:])
+			t.offset = (t.offset + copied) % len(t.static)
+			n += copied
+		}
+	} else {
+		_, _ = t.random.Read(p)
 	}
 	bytesRead := int64(len(p))
 	atomic.AddInt64(&t.count, bytesRead)
@@ -383,6 +1619,29 @@ func (t *timedReader) Read(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// uploadRandom returns the generator for one upload request. Without a seed
+// it is keyed from crypto/rand once, so the payload is still unpredictable and
+// incompressible but costs a fast ChaCha8 step per read instead of a
+// crypto/rand call, which on fast links capped the measured upload.
+func uploadRandom(seed int64) (*mathrand.ChaCha8, error) {
+	if seed != 0 {
+		return seededRandom(seed), nil
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return mathrand.NewChaCha8(key), nil
+}
+
+// seededRandom returns a deterministic generator so every request of every
+// run with the same seed uploads identical bytes.
+func seededRandom(seed int64) *mathrand.ChaCha8 {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], uint64(seed))
+	return mathrand.NewChaCha8(key)
+}
+
 func (t *timedReader) bytes() int64 {
 	return atomic.LoadInt64(&t.count)
 }
@@ -0,0 +1,1124 @@
+package ispeed
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves ServerHandler(cfg) for the length of the test.
+func newTestServer(t *testing.T, cfg ServerConfig) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(ServerHandler(cfg))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// countingServer serves ServerHandler and counts the requests to each path.
+type countingServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func newCountingServer(t *testing.T, cfg ServerConfig) *countingServer {
+	t.Helper()
+	s := &countingServer{hits: map[string]int{}}
+	handler := ServerHandler(cfg)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits[r.URL.Path]++
+		s.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *countingServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+// testConfig is a client configuration that finishes in well under a second
+// against a loopback server.
+func testConfig(baseURL string) ClientConfig {
+	return ClientConfig{
+		BaseURL:        baseURL,
+		Duration:       300 * time.Millisecond,
+		Streams:        2,
+		DownloadMB:     1,
+		PingCount:      2,
+		PingInterval:   0,
+		WarmupDuration: -1,
+		Timeout:        5 * time.Second,
+	}
+}
+
+func TestServerReportedRate(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	for _, mode := range []string{DownloadModeSize, DownloadModeDuration} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testConfig(server.URL)
+			cfg.DownloadMode = mode
+			cfg.ServerRate = true
+			cfg, err := normalizeClientConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := runDownload(context.Background(), server.Client(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// In duration mode the last request of each stream is cut off
+			// without a trailer; it must not wipe out the earlier reports.
+			if res.ServerReportedMbps <= 0 {
+				t.Fatalf("ServerReportedMbps = %v, want > 0", res.ServerReportedMbps)
+			}
+		})
+	}
+}
+
+func TestSamplesDropPartialTail(t *testing.T) {
+	var total int64
+	start := time.Now()
+	since := func() time.Duration { return time.Since(start) }
+	stop := startProgress(ClientConfig{CollectSamples: true}, &total, since, func() {})
+
+	// Full chunks arrive at a steady rate, and the transfer ends mid-interval
+	// with one short read.
+	for end := start.Add(progressTick*3 + progressTick/2); time.Now().Before(end); {
+		atomic.AddInt64(&total, 64<<10)
+		time.Sleep(progressTick / 4)
+	}
+	atomic.AddInt64(&total, 512)
+	samples := stop()
+
+	if len(samples) < 2 {
+		t.Fatalf("got %d samples, want at least 2", len(samples))
+	}
+	rates := make([]float64, len(samples))
+	for i, sample := range samples {
+		rates[i] = sample.Mbps
+	}
+	median := slices.Sorted(slices.Values(rates))[len(rates)/2]
+	if last := rates[len(rates)-1]; last < median/2 {
+		t.Errorf("last sample %.1f Mbps dips below the median %.1f Mbps: %v", last, median, rates)
+	}
+}
+
+func TestSamplesShortPhase(t *testing.T) {
+	total := int64(1000)
+	samples := startProgress(ClientConfig{CollectSamples: true}, &total, func() time.Duration { return 50 * time.Millisecond }, func() {})()
+	if len(samples) != 1 || samples[0].Bytes != total {
+		t.Fatalf("samples = %+v, want one sample of %d bytes", samples, total)
+	}
+}
+
+func TestSmallTransferProbeBestEffort(t *testing.T) {
+	// Tiny downloads are refused, so the probe fails but the test must not.
+	handler := ServerHandler(ServerConfig{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Path == "/download" && size < 64<<10 {
+			http.Error(w, "too small", http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.SmallTransferProbe = true
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("RunClientContext: %v", err)
+	}
+	if result.SmallTransferPenalty != 0 {
+		t.Errorf("SmallTransferPenalty = %v, want 0 for a failed probe", result.SmallTransferPenalty)
+	}
+	if !result.Complete() || result.Download.Mbps <= 0 {
+		t.Errorf("download %.1f Mbps, complete %v: want the test to run on", result.Download.Mbps, result.Complete())
+	}
+}
+
+func TestPingProgressKeepsSubMillisecond(t *testing.T) {
+	server := newTestServer(t, ServerConfig{SimLatency: 500 * time.Microsecond})
+	cfg := testConfig(server.URL)
+	var updates []ProgressUpdate
+	cfg.Progress = func(update ProgressUpdate) { updates = append(updates, update) }
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := runPing(context.Background(), server.Client(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != len(metrics.All) {
+		t.Fatalf("got %d updates for %d samples", len(updates), len(metrics.All))
+	}
+	for i, update := range updates {
+		want := float64(metrics.All[i]) / float64(time.Millisecond)
+		if math.Abs(update.PingMs-want) > 1e-9 {
+			t.Errorf("update %d PingMs = %v, want %v", i, update.PingMs, want)
+		}
+	}
+}
+
+func TestIsIspeedServer(t *testing.T) {
+	ispeedServer := newTestServer(t, ServerConfig{})
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>sign in to continue</html>"))
+	}))
+	defer portal.Close()
+
+	for _, tt := range []struct {
+		name   string
+		server *httptest.Server
+		want   bool
+	}{
+		{"ispeed", ispeedServer, true},
+		{"portal", portal, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.server.Client().Get(tt.server.URL + "/ping")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := isIspeedServer(resp); got != tt.want {
+				t.Errorf("isIspeedServer = %v, want %v", got, tt.want)
+			}
+
+			_, marked, err := ProbeServer(context.Background(), tt.server.Client(), tt.server.URL)
+			if err != nil || marked != tt.want {
+				t.Errorf("ProbeServer marked = %v, %v; want %v", marked, err, tt.want)
+			}
+
+			cfg := testConfig(tt.server.URL)
+			cfg, err = normalizeClientConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := runPing(context.Background(), tt.server.Client(), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metrics.Unmarked == tt.want {
+				t.Errorf("PingMetrics.Unmarked = %v, want %v", metrics.Unmarked, !tt.want)
+			}
+		})
+	}
+}
+
+func TestBytesToMbpsClampsDuration(t *testing.T) {
+	floor := bytesToMbps(1000, minRateDuration)
+	for _, d := range []time.Duration{0, -time.Second, time.Nanosecond} {
+		if got := bytesToMbps(1000, d); got != floor {
+			t.Errorf("bytesToMbps(1000, %v) = %v, want the floor rate %v", d, got, floor)
+		}
+	}
+	if got := bytesToMbps(0, -time.Second); got != 0 {
+		t.Errorf("bytesToMbps(0, -1s) = %v, want 0", got)
+	}
+	if got := bytesToMbps(1_000_000, time.Second); got != 8 {
+		t.Errorf("bytesToMbps(1MB, 1s) = %v, want 8", got)
+	}
+}
+
+// jumpingClock reads 200ms further on each call, except that the third call
+// jumps back as an NTP step of a non-monotonic clock would.
+func jumpingClock() func() time.Duration {
+	var calls int64
+	return func() time.Duration {
+		n := atomic.AddInt64(&calls, 1)
+		if n == 3 {
+			return 100 * time.Millisecond
+		}
+		return time.Duration(n) * progressTick
+	}
+}
+
+func TestSamplesClockJumpBack(t *testing.T) {
+	var total int64
+	stop := startProgress(ClientConfig{CollectSamples: true}, &total, jumpingClock(), func() {})
+	for end := time.Now().Add(progressTick*5 + progressTick/2); time.Now().Before(end); {
+		atomic.AddInt64(&total, 16<<10)
+		time.Sleep(progressTick / 20)
+	}
+	samples := stop()
+
+	// 16 KiB every 10ms is about 13 Mbps; the 1ms floor would make a
+	// backwards interval look hundreds of times faster.
+	for i, sample := range samples {
+		if sample.Mbps > 100 {
+			t.Errorf("sample %d at %v: %.1f Mbps from a backwards clock", i, sample.Elapsed, sample.Mbps)
+		}
+		if i > 0 && sample.Elapsed <= samples[i-1].Elapsed {
+			t.Errorf("sample %d at %v does not follow %v", i, sample.Elapsed, samples[i-1].Elapsed)
+		}
+	}
+}
+
+func TestWarmupClockJumpBack(t *testing.T) {
+	total := int64(1 << 20)
+	elapsed := 2 * time.Second
+	mark := startWarmup(10*time.Millisecond, &total, func() time.Duration { return elapsed })
+	time.Sleep(50 * time.Millisecond)
+
+	// The phase ends "before" the warmup did, so it is measured whole rather
+	// than over a negative window.
+	bytes, window, warmup := mark.measured(2<<20, time.Second)
+	if bytes != 2<<20 || window != time.Second || warmup != 0 {
+		t.Errorf("measured = %d bytes over %v with %v warmup, want the whole phase", bytes, window, warmup)
+	}
+}
+
+func TestDownloadEarlyErrorProgress(t *testing.T) {
+	// One stream fails at once while the other is throttled, so progress
+	// ticks run alongside the failure.
+	var downloads int64
+	handler := ServerHandler(ServerConfig{MaxTotalMbps: 20})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" && atomic.AddInt64(&downloads, 1) == 1 {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var updates, finals int64
+	cfg := testConfig(server.URL)
+	cfg.Progress = func(update ProgressUpdate) {
+		atomic.AddInt64(&updates, 1)
+		if update.Final {
+			atomic.AddInt64(&finals, 1)
+		}
+	}
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = runDownload(context.Background(), server.Client(), cfg)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("err = %v, want the failed stream's *StatusError", err)
+	}
+
+	seen := atomic.LoadInt64(&updates)
+	if seen == 0 {
+		t.Error("no periodic updates while the other stream ran")
+	}
+	if atomic.LoadInt64(&finals) != 0 {
+		t.Error("a failed download sent a Final update")
+	}
+	time.Sleep(2 * progressTick)
+	if late := atomic.LoadInt64(&updates) - seen; late != 0 {
+		t.Errorf("%d updates arrived after runDownload returned", late)
+	}
+}
+
+func TestSlowSubscriberGetsEveryFinal(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	var mu sync.Mutex
+	finals := map[string]int{}
+	cfg.AddProgressSink(func(update ProgressUpdate) {
+		// A subscriber slower than the progress tick.
+		time.Sleep(progressTick)
+		if update.Final {
+			mu.Lock()
+			finals[update.Phase]++
+			mu.Unlock()
+		}
+	})
+	if _, err := RunClientContext(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"ping", "download", "upload"} {
+		if finals[phase] != 1 {
+			t.Errorf("%s: %d Final updates, want exactly 1", phase, finals[phase])
+		}
+	}
+}
+
+func TestSumStreamMbpsStaggered(t *testing.T) {
+	// Three streams move the same megabyte, but one finishes in half the
+	// time and one in a quarter of it.
+	streams := []streamStat{
+		{bytes: 1_000_000, duration: time.Second},
+		{bytes: 1_000_000, duration: time.Second / 2},
+		{bytes: 1_000_000, duration: time.Second / 4},
+	}
+	if got := sumStreamMbps(streams); math.Abs(got-56) > 1e-9 {
+		t.Errorf("sumStreamMbps = %v, want 8 + 16 + 32 = 56", got)
+	}
+	// Over the wall clock the early finishers are diluted by the slowest one.
+	if wall := bytesToMbps(3_000_000, time.Second); wall != 24 {
+		t.Errorf("wall-clock rate = %v, want 24", wall)
+	}
+
+	rates, stdDev := streamRates(streams)
+	if !slices.Equal(rates, []float64{8, 16, 32}) {
+		t.Errorf("streamRates = %v, want [8 16 32]", rates)
+	}
+	mean := 56.0 / 3
+	want := math.Sqrt(((8-mean)*(8-mean) + (16-mean)*(16-mean) + (32-mean)*(32-mean)) / 3)
+	if math.Abs(stdDev-want) > 1e-9 {
+		t.Errorf("stdDev = %v, want %v", stdDev, want)
+	}
+}
+
+func TestRequestCount(t *testing.T) {
+	server := newCountingServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.RequestCount = 5
+	cfg.Streams = 2
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/download", "/upload"} {
+		if got := server.count(path); got != cfg.RequestCount {
+			t.Errorf("%s got %d requests, want %d", path, got, cfg.RequestCount)
+		}
+	}
+	if result.Download.Requests != cfg.RequestCount || result.Upload.Requests != cfg.RequestCount {
+		t.Errorf("reported %d download and %d upload requests, want %d each",
+			result.Download.Requests, result.Upload.Requests, cfg.RequestCount)
+	}
+	if want := int64(cfg.RequestCount) << 20; result.Download.Bytes != want || result.Upload.Bytes != want {
+		t.Errorf("moved %d down and %d up, want %d bytes each", result.Download.Bytes, result.Upload.Bytes, want)
+	}
+}
+
+func TestProgressSinks(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func(ProgressUpdate) {
+		return func(ProgressUpdate) {
+			mu.Lock()
+			calls = append(calls, name)
+			mu.Unlock()
+		}
+	}
+	cfg.Progress = record("progress")
+	cfg.AddProgressSink(record("first"))
+	cfg.AddProgressSink(record("second"))
+	if _, err := RunClientContext(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) == 0 || len(calls)%3 != 0 {
+		t.Fatalf("got %d calls, want a multiple of 3", len(calls))
+	}
+	for i := 0; i < len(calls); i += 3 {
+		if got := calls[i : i+3]; !slices.Equal(got, []string{"progress", "first", "second"}) {
+			t.Fatalf("update %d delivered as %v, want progress, first, second", i/3, got)
+		}
+	}
+}
+
+func TestPostDownload(t *testing.T) {
+	// The stub only starts a download from a POST that names the size.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct{ Bytes int }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Bytes <= 0 {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(make([]byte, body.Bytes))
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.DownloadMethod = http.MethodPost
+	cfg.DownloadBody = `{"bytes": {size}}`
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := runDownload(context.Background(), server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(cfg.DownloadStreams) << 20; res.Bytes != want {
+		t.Errorf("downloaded %d bytes, want %d", res.Bytes, want)
+	}
+
+	cfg.DownloadMethod = http.MethodGet
+	_, _, err = runDownload(context.Background(), server.Client(), cfg)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET err = %v, want a 405 *StatusError", err)
+	}
+}
+
+func TestTotalDownloadMBAcrossStreams(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	for _, streams := range []int{1, 2, 4} {
+		cfg := testConfig(server.URL)
+		cfg.DownloadMB = 0
+		cfg.TotalDownloadMB = 4
+		cfg.Streams = streams
+		cfg, err := normalizeClientConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := runDownload(context.Background(), server.Client(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Bytes != 4<<20 || res.Streams != streams {
+			t.Errorf("%d streams moved %d bytes over %d streams, want %d", streams, res.Bytes, res.Streams, 4<<20)
+		}
+	}
+
+	cfg := testConfig(server.URL)
+	cfg.TotalDownloadMB = 4
+	if _, err := RunClientContext(context.Background(), cfg); err == nil {
+		t.Error("DownloadMB and TotalDownloadMB together were accepted")
+	}
+}
+
+func TestMaxStartupPingAborts(t *testing.T) {
+	server := newCountingServer(t, ServerConfig{SimLatency: 30 * time.Millisecond})
+	cfg := testConfig(server.URL)
+	cfg.MaxStartupPing = 10 * time.Millisecond
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Aborted {
+		t.Errorf("Aborted = false with an average ping of %v", result.Ping.Avg)
+	}
+	if n := server.count("/download") + server.count("/upload"); n != 0 {
+		t.Errorf("%d transfer requests after the abort, want none", n)
+	}
+}
+
+func TestUploadDataSentExactly(t *testing.T) {
+	var received bytes.Buffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(&received, r.Body)
+	}))
+	defer server.Close()
+
+	// An odd length, so the loop wraps in the middle of reads.
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyz!")
+	cfg := testConfig(server.URL)
+	cfg.ChunkSize = 1024
+	limit := int64(len(payload))*3 + 5
+	var total, echoed int64
+	sent, err := uploadOnce(context.Background(), server.Client(), cfg, limit, payload, &total, &echoed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(bytes.Repeat(payload, 3), payload[:5]...)
+	if sent != limit || total != limit || !bytes.Equal(received.Bytes(), want) {
+		t.Errorf("sent %d, counted %d, server got %q; want %q", sent, total, received.Bytes(), want)
+	}
+}
+
+func TestUploadLoadedPing(t *testing.T) {
+	server := newCountingServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.Bufferbloat = true
+	cfg.Duration = 3 * loadedPingInterval
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := runUpload(context.Background(), server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LoadedPing.Samples < 2 || res.LoadedPing.Avg <= 0 {
+		t.Errorf("LoadedPing = %+v, want samples from the whole upload", res.LoadedPing)
+	}
+	if pings := server.count("/ping"); pings < res.LoadedPing.Samples {
+		t.Errorf("server saw %d pings for %d samples", pings, res.LoadedPing.Samples)
+	}
+}
+
+func TestPingOnce(t *testing.T) {
+	const latency = 10 * time.Millisecond
+	server := newCountingServer(t, ServerConfig{SimLatency: latency})
+	for _, base := range []string{server.URL, server.URL + "/"} {
+		elapsed, err := PingOnce(context.Background(), server.Client(), base)
+		if err != nil {
+			t.Fatalf("PingOnce(%q): %v", base, err)
+		}
+		if elapsed < latency {
+			t.Errorf("PingOnce(%q) = %v, want at least %v", base, elapsed, latency)
+		}
+	}
+	if n := server.count("/ping"); n != 2 {
+		t.Errorf("server saw %d pings, want 2", n)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err := PingOnce(context.Background(), http.DefaultClient, closed.URL)
+	var connErr *ConnError
+	if !errors.As(err, &connErr) {
+		t.Errorf("err = %v, want a *ConnError for a closed server", err)
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream down", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	_, err = PingOnce(context.Background(), broken.Client(), broken.URL)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusInternalServerError {
+		t.Errorf("err = %v, want a 500 *StatusError", err)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	_, err = PingOnce(context.Background(), missing.Client(), missing.URL)
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Errorf("err = %v, want a 404 *StatusError", err)
+	}
+}
+
+func TestStreamsPerDirection(t *testing.T) {
+	server := newCountingServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.Streams = 2
+	cfg.DownloadStreams = 3
+	cfg.UploadStreams = 1
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Download.Streams != 3 || len(result.Download.StreamMbps) != 3 {
+		t.Errorf("download used %d streams, want 3", result.Download.Streams)
+	}
+	if result.Upload.Streams != 1 || len(result.Upload.StreamMbps) != 1 {
+		t.Errorf("upload used %d streams, want 1", result.Upload.Streams)
+	}
+	// In size mode each download stream makes exactly one request.
+	if n := server.count("/download"); n != 3 {
+		t.Errorf("server saw %d downloads, want 3", n)
+	}
+}
+
+func TestShortDownloadCompletesProgress(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		contentLength bool
+	}{
+		{"content length", true},
+		{"chunked", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server caps every download at half the requested size.
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+				if tt.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(size/2))
+				}
+				_, _ = w.Write(make([]byte, size/2))
+			}))
+			defer server.Close()
+
+			cfg, err := normalizeClientConfig(testConfig(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			const size = 1 << 20
+			var total int64
+			target := int64(size)
+			info, err := downloadOnce(context.Background(), server.Client(), cfg, size, make([]byte, cfg.ChunkSize), &total, &target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.bytes != size/2 || total != size/2 {
+				t.Fatalf("got %d bytes, counted %d, want %d", info.bytes, total, size/2)
+			}
+			if percent := percentDone(total, target); percent != 100 {
+				t.Errorf("progress ends at %.1f%% with target %d, want 100%%", percent, target)
+			}
+		})
+	}
+}
+
+// BenchmarkTimedReader compares the upload payload generator with the
+// crypto/rand call per read it replaced, which capped uploads on fast links.
+func TestEchoUpload(t *testing.T) {
+	server := newTestServer(t, ServerConfig{EchoUpload: true})
+	cfg := testConfig(server.URL)
+	cfg.EchoUpload = true
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := result.Upload
+	if result.UploadErr != nil || up.Bytes == 0 || up.EchoBytes == 0 || up.EchoBytes > up.Bytes || up.EchoMbps <= 0 {
+		t.Errorf("echo upload: err %v, sent %d, echoed %d at %.1f Mbps", result.UploadErr, up.Bytes, up.EchoBytes, up.EchoMbps)
+	}
+
+	// A server without the echo must fail the upload rather than report
+	// a one-way rate.
+	plain := newTestServer(t, ServerConfig{})
+	cfg.BaseURL = plain.URL
+	result, err = RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(result.UploadErr, ErrUnsupported) {
+		t.Errorf("echo against a plain server: upload error %v, want ErrUnsupported", result.UploadErr)
+	}
+}
+
+func TestQuick(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Quick runs a fixed three second upload")
+	}
+	server := newTestServer(t, ServerConfig{})
+	result, err := Quick(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete() {
+		t.Fatalf("Quick left phases failed: ping %v, download %v, upload %v", result.PingErr, result.DownloadErr, result.UploadErr)
+	}
+	if result.Ping.Samples != 3 || result.Download.Bytes == 0 || result.Upload.Bytes == 0 {
+		t.Errorf("Quick: %d pings, %d bytes down, %d up", result.Ping.Samples, result.Download.Bytes, result.Upload.Bytes)
+	}
+}
+
+func TestDownloadHostAfterRedirect(t *testing.T) {
+	target := newTestServer(t, ServerConfig{})
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	cfg, err := normalizeClientConfig(testConfig(redirector.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, host, err := runDownload(context.Background(), redirector.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := target.Listener.Addr().String(); host != want || res.Bytes == 0 {
+		t.Errorf("download host %q after %d bytes, want %q", host, res.Bytes, want)
+	}
+}
+
+func TestSeededUploadRepeats(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	upload := func(seed int64) []byte {
+		t.Helper()
+		cfg := testConfig(server.URL)
+		cfg.ChunkSize = 4096
+		cfg.Seed = seed
+		var total, echoed int64
+		if _, err := uploadOnce(context.Background(), server.Client(), cfg, 64<<10, nil, &total, &echoed); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies[len(bodies)-1]
+	}
+
+	first, again, other := upload(42), upload(42), upload(43)
+	if !bytes.Equal(first, again) {
+		t.Error("two uploads with the same seed sent different bytes")
+	}
+	if bytes.Equal(first, other) {
+		t.Error("uploads with different seeds sent the same bytes")
+	}
+	if bytes.Equal(upload(0), upload(0)) {
+		t.Error("unseeded uploads repeated their bytes")
+	}
+}
+
+func TestTrailingSlashServer(t *testing.T) {
+	// Like some routers, this server only answers paths that end in a slash.
+	handler := ServerHandler(ServerConfig{})
+	var mu sync.Mutex
+	var served []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutSuffix(r.URL.Path, "/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		served = append(served, path)
+		mu.Unlock()
+		r.URL.Path = path
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete() || result.Ping.Samples != cfg.PingCount {
+		t.Fatalf("run against a trailing-slash server: %d pings, errors %v, %v, %v",
+			result.Ping.Samples, result.PingErr, result.DownloadErr, result.UploadErr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/ping", "/download", "/upload"} {
+		if !slices.Contains(served, path) {
+			t.Errorf("%s/ was never requested; served %v", path, served)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.SkipPing = true
+	cfg.Streams = 1
+
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	want := Meta{OS: runtime.GOOS, Arch: runtime.GOARCH, Hostname: hostname, Version: Version}
+	if result.Meta != want {
+		t.Errorf("Meta = %+v, want %+v", result.Meta, want)
+	}
+
+	cfg.OmitMeta = true
+	result, err = RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Meta != (Meta{}) {
+		t.Errorf("Meta with OmitMeta = %+v, want empty", result.Meta)
+	}
+}
+
+func TestTraceConnReuse(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.PingCount = 4
+	cfg.Trace = true
+
+	ping, err := runTestPing(t, server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Back-to-back pings to one host open a connection once and keep it.
+	if want := (ConnStats{Reused: 3, New: 1}); ping.Conns != want {
+		t.Errorf("ping Conns = %+v, want %+v", ping.Conns, want)
+	}
+
+	cfg.Trace = false
+	ping, err = runTestPing(t, server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.Conns != (ConnStats{}) {
+		t.Errorf("ping Conns without Trace = %+v, want zero", ping.Conns)
+	}
+}
+
+func TestClockFromFirstByte(t *testing.T) {
+	const setup = 200 * time.Millisecond
+	server := newTestServer(t, ServerConfig{})
+
+	download := func(fromFirstByte bool) SpeedMetrics {
+		t.Helper()
+		cfg := testConfig(server.URL)
+		cfg.Streams = 1
+		cfg.ClockFromFirstByte = fromFirstByte
+		// A slow dial stands in for DNS and connection setup.
+		cfg.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			time.Sleep(setup)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+		cfg, err := normalizeClientConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := newHTTPClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := runDownload(context.Background(), client, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := download(false); res.Duration < setup {
+		t.Errorf("download took %v without ClockFromFirstByte, want at least the %v setup", res.Duration, setup)
+	}
+	if res := download(true); res.Duration >= setup || res.Bytes == 0 {
+		t.Errorf("download of %d bytes took %v with ClockFromFirstByte, want the %v setup left out", res.Bytes, res.Duration, setup)
+	}
+}
+
+func TestJitterSize(t *testing.T) {
+	const size = 1 << 20
+	for _, pct := range []float64{0, 10, 90} {
+		low, high := int64(size*(1-pct/100)), int64(size*(1+pct/100))
+		seen := make(map[int64]bool)
+		for range 1000 {
+			got := jitterSize(size, pct)
+			if got < low || got > high {
+				t.Fatalf("jitterSize(%d, %v) = %d, outside [%d, %d]", size, pct, got, low, high)
+			}
+			seen[got] = true
+		}
+		if pct > 0 && len(seen) < 2 {
+			t.Errorf("jitterSize(%d, %v) never varied", size, pct)
+		}
+	}
+	for range 100 {
+		if got := jitterSize(1, 90); got != 1 {
+			t.Fatalf("jitterSize(1, 90) = %d, want 1", got)
+		}
+	}
+}
+
+func TestSkipPing(t *testing.T) {
+	server := newCountingServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	cfg.SkipPing = true
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.count("/ping"); n != 0 || result.Ping.Samples != 0 {
+		t.Errorf("SkipPing sent %d pings and reported %d samples", n, result.Ping.Samples)
+	}
+
+	// Loaded latency is still sampled, but has no idle latency to be
+	// compared with.
+	server = newCountingServer(t, ServerConfig{})
+	cfg = testConfig(server.URL)
+	cfg.SkipPing = true
+	cfg.Bufferbloat = true
+	result, err = RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.count("/ping") == 0 || result.Upload.LoadedPing.Samples == 0 {
+		t.Errorf("Bufferbloat with SkipPing sent %d pings, %d loaded upload samples", server.count("/ping"), result.Upload.LoadedPing.Samples)
+	}
+	if result.Download.LoadedPingDelta != 0 || result.Upload.LoadedPingDelta != 0 {
+		t.Errorf("loaded latency deltas %v and %v without an idle ping", result.Download.LoadedPingDelta, result.Upload.LoadedPingDelta)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body first so the client always sees the status rather
+		// than a reset connection.
+		_, _ = io.Copy(io.Discard, r.Body)
+		http.Error(w, "token expired", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	upload := func(partialOK bool) (SpeedMetrics, error) {
+		t.Helper()
+		cfg := testConfig(server.URL)
+		cfg.UploadMB = 1
+		cfg.RequestCount = 2
+		cfg.PartialOK = partialOK
+		cfg, err := normalizeClientConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runUpload(context.Background(), server.Client(), cfg)
+	}
+
+	_, err := upload(false)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusUnauthorized || !strings.Contains(statusErr.Body, "token expired") {
+		t.Errorf("rejected upload returned %v, want a 401 StatusError with the body", err)
+	}
+
+	res, err := upload(true)
+	if err != nil {
+		t.Fatalf("rejected upload with PartialOK: %v", err)
+	}
+	if res.Rejected != 2 || res.Requests != 0 {
+		t.Errorf("PartialOK upload counted %d rejected and %d accepted requests, want 2 and 0", res.Rejected, res.Requests)
+	}
+}
+
+func TestServerInfoCatchAll(t *testing.T) {
+	// A catch-all route answers /info with an empty JSON object, which must
+	// not read as a server without upload support.
+	handler := ServerHandler(ServerConfig{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, "{}")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	if info := fetchServerInfo(context.Background(), server.Client(), cfg); info != nil {
+		t.Errorf("fetchServerInfo from a catch-all route = %+v, want nil", info)
+	}
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UploadErr != nil || result.Upload.Bytes == 0 {
+		t.Errorf("upload after a catch-all /info: %d bytes, %v", result.Upload.Bytes, result.UploadErr)
+	}
+
+	real := newTestServer(t, ServerConfig{})
+	if info := fetchServerInfo(context.Background(), real.Client(), testConfig(real.URL)); info == nil || !info.Upload {
+		t.Errorf("fetchServerInfo from an ispeed server = %+v", info)
+	}
+}
+
+func TestEmptyUploadData(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	cfg := testConfig(server.URL)
+	// Piped but empty stdin reads as a non-nil, empty slice; it must fall
+	// back to generated data rather than crash.
+	cfg.UploadData = []byte{}
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := runUpload(context.Background(), server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bytes == 0 || res.StaticPayload {
+		t.Errorf("upload with empty UploadData sent %d bytes, static payload %v", res.Bytes, res.StaticPayload)
+	}
+}
+
+func BenchmarkTimedReader(b *testing.B) {
+	b.Run("chacha8", func(b *testing.B) {
+		random, err := uploadRandom(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkRead(b, &timedReader{ctx: context.Background(), chunkSize: DefaultChunkSize, random: random})
+	})
+	b.Run("static", func(b *testing.B) {
+		static := make([]byte, DefaultChunkSize)
+		benchmarkRead(b, &timedReader{ctx: context.Background(), chunkSize: DefaultChunkSize, static: static})
+	})
+	b.Run("crypto-rand", func(b *testing.B) {
+		benchmarkRead(b, rand.Reader)
+	})
+}
+
+// BenchmarkUploadOnce sends 4 MiB uploads to a loopback server with the
+// random and the static payload.
+func BenchmarkUploadOnce(b *testing.B) {
+	server := httptest.NewServer(ServerHandler(ServerConfig{}))
+	defer server.Close()
+	cfg := ClientConfig{BaseURL: server.URL, ChunkSize: DefaultChunkSize}
+	const size = 4 << 20
+
+	for _, tt := range []struct {
+		name   string
+		static []byte
+	}{
+		{"random", nil},
+		{"static", make([]byte, DefaultChunkSize)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(size)
+			var total, echoed int64
+			for b.Loop() {
+				if _, err := uploadOnce(context.Background(), server.Client(), cfg, size, tt.static, &total, &echoed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDownloadOnce(b *testing.B) {
+	server := httptest.NewServer(ServerHandler(ServerConfig{}))
+	defer server.Close()
+	const size = 4 << 20
+
+	for _, tt := range []struct {
+		name       string
+		simpleCopy bool
+	}{
+		{"readAll", false},
+		{"SimpleCopy", true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			cfg, err := normalizeClientConfig(ClientConfig{BaseURL: server.URL, SimpleCopy: tt.simpleCopy})
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, cfg.ChunkSize)
+			b.SetBytes(size)
+			var total, target int64
+			for b.Loop() {
+				if _, err := downloadOnce(context.Background(), server.Client(), cfg, size, buf, &total, &target); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkRead(b *testing.B, r io.Reader) {
+	buf := make([]byte, DefaultChunkSize)
+	b.SetBytes(int64(len(buf)))
+	for b.Loop() {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
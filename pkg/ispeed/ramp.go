@@ -0,0 +1,58 @@
+package ispeed
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// rampStepDuration is how long each burst of the stream ramp downloads;
+	// with the default warmup the rate covers its last two seconds.
+	rampStepDuration = 3 * time.Second
+	// rampMinGain is the smallest improvement, as a fraction, that doubling
+	// the streams must bring for the ramp to keep going.
+	rampMinGain = 0.1
+)
+
+// rampStreamCounts are the stream counts the ramp tries, in order.
+var rampStreamCounts = []int{1, 2, 4, 8}
+
+// runRamp downloads in short bursts at 1, 2, 4 and 8 streams and stops once
+// doubling the streams raises the rate by less than rampMinGain. It returns
+// each burst's rate and the knee: the last stream count that still gained
+// that much, past which more streams do not help. A knee above 1 points at a
+// per-flow limit, such as a window too small for the bandwidth-delay product.
+func runRamp(ctx context.Context, client *http.Client, cfg ClientConfig) ([]RampStep, int, error) {
+	burst := cfg
+	burst.DownloadMode = DownloadModeDuration
+	burst.Duration = rampStepDuration
+	burst.MaxDuration = 0
+	burst.RequestCount = 0
+	burst.Bufferbloat = false
+	burst.CollectSamples = false
+	// The bursts are not the download phase, so they stay off its progress bar.
+	burst.Progress = nil
+	burst.ProgressSinks = nil
+
+	var profile []RampStep
+	var knee int
+	var best float64
+	for _, streams := range rampStreamCounts {
+		// Each burst opens its own connections so none inherits another's
+		// congestion window.
+		client.CloseIdleConnections()
+		burst.DownloadStreams = streams
+		res, _, err := runDownload(ctx, client, burst)
+		if err != nil {
+			return nil, 0, fmt.Errorf("stream ramp at %d streams: %w", streams, err)
+		}
+		profile = append(profile, RampStep{Streams: streams, Mbps: res.Mbps})
+		if knee > 0 && res.Mbps < best*(1+rampMinGain) {
+			break
+		}
+		knee, best = streams, res.Mbps
+	}
+	return profile, knee, nil
+}
@@ -0,0 +1,41 @@
+package ispeed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRampFailureKeepsResult(t *testing.T) {
+	// The first download, the ramp's opening burst, is refused; every later
+	// one is served.
+	var downloads int64
+	handler := ServerHandler(ServerConfig{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" && atomic.AddInt64(&downloads, 1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.RampStreams = true
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("RunClientContext: %v", err)
+	}
+	if result.RampErr == nil {
+		t.Error("RampErr is nil, want the refused burst")
+	}
+	if result.Ping.Samples == 0 || result.Download.Mbps <= 0 || result.Upload.Mbps <= 0 {
+		t.Errorf("ping %d samples, download %.1f, upload %.1f Mbps: want all measured",
+			result.Ping.Samples, result.Download.Mbps, result.Upload.Mbps)
+	}
+	if !result.Complete() {
+		t.Error("Complete() = false, but only the ramp failed")
+	}
+}
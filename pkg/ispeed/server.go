@@ -0,0 +1,288 @@
+package ispeed
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serverShutdownTimeout bounds how long in-flight transfers may take to finish
+// once the server is asked to stop.
+const serverShutdownTimeout = 5 * time.Second
+
+// RunServer serves the ping, download and upload endpoints on cfg.Addr until
+// the process receives SIGINT or SIGTERM, then shuts down gracefully.
+func RunServer(cfg ServerConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return RunServerContext(ctx, cfg)
+}
+
+// RunServerContext is RunServer that stops when ctx is done instead of on a
+// signal. It returns nil after a clean shutdown.
+func RunServerContext(ctx context.Context, cfg ServerConfig) error {
+	cfg = normalizeServerConfig(cfg)
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           ServerHandler(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func ServerHandler(cfg ServerConfig) http.Handler {
+	cfg = normalizeServerConfig(cfg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		handlePing(w, r, cfg)
+	})
+	mux.HandleFunc("/ws-ping", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocketPing(w, r, cfg)
+	})
+	var limiter *rateLimiter
+	if cfg.MaxTotalMbps > 0 {
+		limiter = newRateLimiter(cfg.MaxTotalMbps * 1_000_000 / 8)
+	}
+	var active int64
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		handleDownload(w, r, cfg, limiter)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		handleUpload(w, r, cfg)
+	})
+	mux.HandleFunc("/load", func(w http.ResponseWriter, r *http.Request) {
+		handleLoad(w, cfg, atomic.LoadInt64(&active))
+	})
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		handleInfo(w, cfg)
+	})
+	return withMarker(mux)
+}
+
+// withMarker tags every response so clients can tell an ispeed server apart
+// from a captive portal or an unrelated service answering on the same path.
+func withMarker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(MarkerHeader, Version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func normalizeServerConfig(cfg ServerConfig) ServerConfig {
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultServerAddr
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.ReadLimit <= 0 {
+		cfg.ReadLimit = DefaultReadLimit
+	}
+	if cfg.SimLatency < 0 {
+		cfg.SimLatency = 0
+	}
+	if cfg.LoadStreams <= 0 {
+		cfg.LoadStreams = DefaultLoadStreams
+	}
+	if cfg.MaxTotalMbps < 0 {
+		cfg.MaxTotalMbps = 0
+	}
+	cfg.SimLossRate = min(max(cfg.SimLossRate, 0), 1)
+
+	return cfg
+}
+
+func handlePing(w http.ResponseWriter, r *http.Request, cfg ServerConfig) {
+	if cfg.SimLatency > 0 {
+		select {
+		case <-time.After(cfg.SimLatency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if cfg.SimLossRate > 0 && mathrand.Float64() < cfg.SimLossRate {
+		// Abort the connection without a response so the client sees a lost ping.
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("pong"))
+}
+
+// handleLoad reports how busy the server is so clients choosing between
+// similarly close servers can pick a quieter one.
+func handleLoad(w http.ResponseWriter, cfg ServerConfig, active int64) {
+	report := LoadReport{
+		ActiveStreams: int(active),
+		Load:          min(float64(active)/float64(cfg.LoadStreams), 1),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// handleInfo describes what this server supports and the size limits it
+// enforces, so clients do not have to find out by failing.
+func handleInfo(w http.ResponseWriter, cfg ServerConfig) {
+	info := ServerInfo{
+		Version:          Version,
+		Upload:           true,
+		EchoUpload:       cfg.EchoUpload,
+		WebSocketPing:    true,
+		MaxDownloadBytes: cfg.MaxBytes,
+		MaxUploadBytes:   cfg.ReadLimit,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+func parseSizeParam(r *http.Request, maxBytes int64) int64 {
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		return maxBytes
+	}
+	return min(size, maxBytes)
+}
+
+func handleDownload(w http.ResponseWriter, r *http.Request, cfg ServerConfig, limiter *rateLimiter) {
+	size := parseSizeParam(r, cfg.MaxBytes)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// A trailer needs chunked encoding on HTTP/1.1, so the sending rate is only
+	// reported to clients that advertise trailer support.
+	reportRate := strings.Contains(strings.ToLower(r.Header.Get("TE")), "trailers")
+	if reportRate {
+		w.Header().Set("Trailer", SentRateTrailer)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	chunk := make([]byte, DefaultChunkSize)
+	_, _ = rand.Read(chunk)
+	start := time.Now()
+	for remaining := size; remaining > 0; {
+		n := min(remaining, int64(len(chunk)))
+		if limiter != nil {
+			if err := limiter.wait(r.Context(), n); err != nil {
+				return
+			}
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		remaining -= n
+	}
+
+	if reportRate {
+		bps := float64(size) * 8 / max(time.Since(start), minRateDuration).Seconds()
+		w.Header().Set(SentRateTrailer, strconv.FormatFloat(bps, 'f', 0, 64))
+	}
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request, cfg ServerConfig) {
+	if cfg.EchoUpload {
+		handleEchoUpload(w, r, cfg)
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(r.Body, cfg.ReadLimit))
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// handleEchoUpload streams the request body back as it arrives so the client
+// can measure both directions of one connection at once.
+func handleEchoUpload(w http.ResponseWriter, r *http.Request, cfg ServerConfig) {
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 stops reading the request once the response starts unless full
+	// duplex is enabled. HTTP/2 is always full duplex and reports an error here.
+	_ = rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	body := io.LimitReader(r.Body, cfg.ReadLimit)
+	buf := make([]byte, DefaultChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rateLimiter caps the combined rate of all callers. Each wait reserves the
+// next free slot on a shared schedule, so concurrent downloads interleave and
+// split the budget instead of the first one taking all of it.
+type rateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	next        time.Time
+}
+
+func newRateLimiter(bytesPerSec float64) *rateLimiter {
+	return &rateLimiter{bytesPerSec: bytesPerSec}
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	l.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
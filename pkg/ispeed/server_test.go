@@ -0,0 +1,108 @@
+package ispeed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runTestPing runs the ping phase of cfg with client.
+func runTestPing(t *testing.T, client *http.Client, cfg ClientConfig) (PingMetrics, error) {
+	t.Helper()
+	cfg, err := normalizeClientConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runPing(context.Background(), client, &cfg)
+}
+
+func TestSimLatency(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	server := newTestServer(t, ServerConfig{SimLatency: latency})
+	cfg := testConfig(server.URL)
+	cfg.PingCount = 3
+	metrics, err := runTestPing(t, server.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Min < latency {
+		t.Errorf("Min = %v, want at least the simulated %v", metrics.Min, latency)
+	}
+}
+
+func TestSimLossRetransmits(t *testing.T) {
+	server := newTestServer(t, ServerConfig{SimLossRate: 0.2})
+	// A lost ping on a kept-alive connection would be retried by the transport
+	// itself, out of sight of the client's retry count.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	cfg := testConfig(server.URL)
+	cfg.PingCount = 50
+	cfg.PingRetries = 8
+	metrics, err := runTestPing(t, client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Samples != cfg.PingCount {
+		t.Errorf("Samples = %d, want %d", metrics.Samples, cfg.PingCount)
+	}
+	if metrics.Retransmits == 0 {
+		t.Error("Retransmits = 0, want the simulated loss to show")
+	}
+}
+
+func TestSimTotalLossFails(t *testing.T) {
+	server := newTestServer(t, ServerConfig{SimLossRate: 1})
+	cfg := testConfig(server.URL)
+	cfg.PingRetries = 1
+	_, err := runTestPing(t, server.Client(), cfg)
+	var connErr *ConnError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("err = %v, want a *ConnError", err)
+	}
+}
+
+func TestMaxTotalMbpsSharedAcrossDownloads(t *testing.T) {
+	const (
+		capMbps = 40
+		size    = 1 << 20
+	)
+	server := newTestServer(t, ServerConfig{MaxTotalMbps: capMbps})
+
+	var elapsed [2]time.Duration
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range elapsed {
+		wg.Go(func() {
+			resp, err := server.Client().Get(server.URL + "/download?size=" + strconv.Itoa(size))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+				t.Errorf("download %d: read %d bytes, %v", i, n, err)
+			}
+			elapsed[i] = time.Since(start)
+		})
+	}
+	wg.Wait()
+	total := time.Since(start)
+
+	// The first chunk goes out before the limiter has anything to wait for,
+	// so allow for it on top of the cap.
+	if got := bytesToMbps(2*size-DefaultChunkSize, total); got > capMbps {
+		t.Errorf("two downloads together ran at %.1f Mbps, cap %d", got, capMbps)
+	}
+	// The downloads share the budget rather than running one after the
+	// other, so neither finishes far ahead of the pair.
+	for i, d := range elapsed {
+		if d < total*3/4 {
+			t.Errorf("download %d finished after %v of %v", i, d, total)
+		}
+	}
+}
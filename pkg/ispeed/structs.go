@@ -1,6 +1,11 @@
 package ispeed
 
-import "time"
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
 
 const (
 	DefaultServerAddr = ":8080"
@@ -13,24 +18,262 @@ const (
 	DefaultTimeout    = 30 * time.Second
 	DefaultMaxBytes   = int64(1024 * 1024 * 1024)
 	DefaultReadLimit  = int64(512 * 1024 * 1024)
+
+	DefaultProbeConcurrency = 4
+	DefaultProbeSamples     = 3
+	DefaultLoadStreams      = 32
+	DefaultPingRetries      = 2
+	// DefaultPingInterval spaces out ping samples so they do not queue behind
+	// each other.
+	DefaultPingInterval = 150 * time.Millisecond
+	// DefaultWarmup covers TCP slow start on most links.
+	DefaultWarmup = time.Second
+	// DefaultStableCV is the rate variation adaptive stopping accepts as
+	// settled: a standard deviation of 5% of the mean.
+	DefaultStableCV = 0.05
+
+	MarkerHeader    = "X-Ispeed"
+	SentRateTrailer = "X-Ispeed-Sent-Bps"
+)
+
+// Ping modes for ClientConfig.PingMode.
+const (
+	PingModeHTTP      = "http"
+	PingModeWebSocket = "websocket"
+)
+
+// Download modes for ClientConfig.DownloadMode.
+const (
+	DownloadModeSize     = "size"
+	DownloadModeDuration = "duration"
+)
+
+// IP versions for ClientConfig.IPVersion.
+const (
+	IPVersionAuto = "auto"
+	IPVersion4    = "4"
+	IPVersion6    = "6"
 )
 
+// Version is reported in the X-Ispeed header and can be set at build time
+// with -ldflags "-X github.com/yashsinghcodes/ispeed/pkg/ispeed.Version=...".
+var Version = "dev"
+
 type ServerConfig struct {
 	Addr      string
 	MaxBytes  int64
 	ReadLimit int64
+	// SimLatency and SimLossRate degrade /ping on purpose. They exist for
+	// exercising client latency and loss handling and must not be set on a
+	// server that real users measure against.
+	SimLatency  time.Duration
+	SimLossRate float64
+	// MaxTotalMbps, when positive, caps the combined rate of all downloads in
+	// flight so one client cannot take the whole uplink of a shared host.
+	MaxTotalMbps float64
+	// LoadStreams is the number of concurrent downloads and uploads that /load
+	// reports as full load.
+	LoadStreams int
+	// EchoUpload makes /upload stream the received bytes back to the client
+	// for full-duplex measurements.
+	EchoUpload bool
+}
+
+// LoadReport is the body of a server's /load response.
+type LoadReport struct {
+	ActiveStreams int     `json:"active_streams"`
+	Load          float64 `json:"load"`
+}
+
+// ServerInfo is the body of a server's /info response: what it supports, so a
+// client can adapt before testing instead of failing a phase.
+type ServerInfo struct {
+	Version       string `json:"version"`
+	Upload        bool   `json:"upload"`
+	EchoUpload    bool   `json:"echo_upload"`
+	WebSocketPing bool   `json:"websocket_ping"`
+	// MaxDownloadBytes is the most one download request returns and
+	// MaxUploadBytes the most of one upload request the server reads. Zero
+	// means no stated limit.
+	MaxDownloadBytes int64 `json:"max_download_bytes"`
+	MaxUploadBytes   int64 `json:"max_upload_bytes"`
 }
 
 type ClientConfig struct {
-	BaseURL    string
-	Duration   time.Duration
-	Streams    int
-	ChunkSize  int
-	DownloadMB int
-	PingCount  int
-	Timeout    time.Duration
+	BaseURL  string
+	Duration time.Duration
+	Streams  int
+	// DownloadStreams and UploadStreams override Streams for one direction,
+	// since links often handle parallelism differently each way.
+	DownloadStreams int
+	UploadStreams   int
+	ChunkSize       int
+	DownloadMB      int
+	// TotalDownloadMB splits a fixed budget across all streams so the amount
+	// of data does not change with Streams. It cannot be combined with DownloadMB.
+	TotalDownloadMB int
+	// UploadMB, when set, makes each upload stream send exactly this many
+	// megabytes in one request and stop instead of running for Duration, to
+	// mirror the download's size mode. RequestCount overrides it.
+	UploadMB int
+	// SizeJitterPct varies each download request size randomly by up to this
+	// percentage around the nominal size, to emulate mixed traffic. Capped at 90.
+	SizeJitterPct float64
+	PingCount     int
+	// PingMode is PingModeHTTP (the default), a GET of /ping per sample, or
+	// PingModeWebSocket, which echoes frames over one WebSocket to /ws-ping
+	// and leaves connection setup out of every sample. Only the Go server
+	// has /ws-ping. WebSocket pings are not retried and do not fill Conns.
+	PingMode string
+	// IPVersion pins every connection to IPv4 (IPVersion4) or IPv6
+	// (IPVersion6). IPVersionAuto, the default, leaves the choice to the
+	// resolver and Go's dual-stack dialing; Result.IPVersion shows what won.
+	IPVersion string
+	// PingInterval is the pause between ping samples. Zero sends them back to
+	// back in a tight burst; a negative value uses DefaultPingInterval.
+	PingInterval time.Duration
+	// PingRetries is how many times a failed ping sample is retried, with
+	// exponential backoff, before the run fails. Zero uses DefaultPingRetries
+	// and a negative value disables retries.
+	PingRetries int
+	// SkipPing leaves out the ping phase for throughput-only runs. Result.Ping
+	// stays zero, with Samples 0 marking it as not measured. Bufferbloat still
+	// pings during the throughput phases, but without an idle baseline
+	// LoadedPingDelta stays zero.
+	SkipPing bool
+	// RequestCount, when set, makes download and upload each issue exactly this
+	// many requests of DownloadMB megabytes instead of running for Duration.
+	RequestCount int
+	// DownloadMode is DownloadModeSize (the default), where each stream stops
+	// after DownloadMB megabytes, or DownloadModeDuration, where the streams
+	// keep downloading until Duration has passed. RequestCount overrides both.
+	DownloadMode string
+	// WarmupDuration is how long the start of the download and upload is
+	// left out of their rates, while TCP slow start ramps up. Zero uses
+	// DefaultWarmup and a negative value measures from the first byte.
+	WarmupDuration time.Duration
+	// MaxDuration, when set, turns on adaptive stopping: the download and the
+	// upload each end as soon as their rate has settled, judged by StableCV
+	// over a 2s sliding window, but never before MinDuration and never after
+	// MaxDuration, which replaces Duration. The download runs in
+	// DownloadModeDuration; RequestCount and UploadMB keep their fixed work.
+	MaxDuration time.Duration
+	MinDuration time.Duration
+	// StableCV is the largest coefficient of variation (standard deviation
+	// over mean) of the sampled rate that counts as settled. Zero uses
+	// DefaultStableCV.
+	StableCV float64
+	// DownloadMethod is GET or POST. For POST, DownloadBody is sent as the
+	// request body with every "{size}" replaced by the requested byte count.
+	DownloadMethod string
+	DownloadBody   string
+	Timeout        time.Duration
+	// MaxStartupPing skips download and upload when the average ping is above
+	// it, so a clearly bad link does not burn a large transfer.
+	MaxStartupPing time.Duration
+	// CAFile is a PEM bundle trusted in place of the system roots.
+	CAFile string
+	// ProxyURL routes every request through an http://, https:// or
+	// socks5:// proxy instead of the one from the environment. The proxy's
+	// own overhead is part of what gets measured.
+	ProxyURL string
+	// DialContext, when set, opens every connection the client makes, e.g. to
+	// run the test through a tunnel or over an in-memory connection.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+	// MaxProbeConcurrency bounds how many servers are probed at once during
+	// server selection.
+	MaxProbeConcurrency int
+	// ProbeSamples is how many pings each server gets during selection; the
+	// median decides, so one latency spike does not pick a worse server.
+	ProbeSamples int
+	// StaticUpload sends one pre-filled buffer repeatedly, skipping per-read
+	// randomization for CPU-limited devices.
+	StaticUpload bool
+	// Bufferbloat pings the server in the background during the download and
+	// upload phases to measure latency under load.
+	Bufferbloat bool
+	// SmallTransferProbe runs a short experimental pre-pass of tiny downloads
+	// to spot paths where small transfers are anomalously slow, which can point
+	// at MTU or fragmentation problems. See Result.SmallTransferPenalty.
+	SmallTransferProbe bool
+	// RampStreams runs short download bursts at 1, 2, 4 and 8 streams before
+	// the download, until more streams stop helping. See Result.RampProfile.
+	RampStreams bool
+	// EchoUpload reads the upload back from a server running with
+	// ServerConfig.EchoUpload while sending it, to exercise full duplex.
+	EchoUpload bool
+	// SimpleCopy drains downloads with io.Copy instead of the ChunkSize read
+	// loop, for comparison with naive tools.
+	SimpleCopy bool
+	// ForceHTTP1 turns off HTTP/2 so h1 and h2 throughput can be compared;
+	// SpeedMetrics.Protocol shows what the download actually used.
+	ForceHTTP1 bool
+	// PartialOK keeps the run going when the server rejects an upload with a
+	// non-2xx status, counting it in SpeedMetrics.Rejected instead of failing
+	// with a *StatusError.
+	PartialOK bool
+	// Seed, when non-zero, generates the upload payload from a deterministic
+	// PRNG so repeated runs send identical bytes. Zero keys the PRNG from
+	// crypto/rand for every request.
+	Seed int64
+	// UploadData, when non-empty, is sent in a loop as the upload body by
+	// every stream instead of generated data.
+	UploadData []byte `json:"-"`
+	// ServerRate asks the server to report its own sending rate for each
+	// download so it can be compared against the received rate.
+	ServerRate bool
 	JSON       bool
-	Progress   func(ProgressUpdate)
+	// Label is free-form text carried into Result, e.g. "before VPN".
+	Label string
+	// ClockFromFirstByte starts the download clock at the first response byte
+	// instead of before the requests go out, leaving out slow stream setup.
+	ClockFromFirstByte bool
+	// Trace records connection reuse for each phase in its Conns field.
+	Trace bool
+	// TCPInfo reads the kernel's TCP_INFO from every connection the run opens
+	// and sums it in Result.TCP. It only yields data on Linux.
+	TCPInfo bool
+	// ConnTrace breaks the first HTTP ping down into DNS, connect, TLS and
+	// time to first byte in PingMetrics.Timing.
+	ConnTrace bool
+	// CollectSamples records each phase's throughput every 200ms in
+	// SpeedMetrics.Samples, with or without a progress callback.
+	CollectSamples bool
+	// Strict makes RunClient fail instead of substituting a default for any
+	// unset or invalid field, for benchmarks that must run exactly as configured.
+	// Zero DownloadStreams and UploadStreams still mean Streams, and negative
+	// WarmupDuration and PingRetries still turn those off.
+	Strict bool
+	// OmitMeta leaves Result.Meta empty, e.g. to keep the hostname out of
+	// shared logs.
+	OmitMeta bool
+	// Logger, when set, receives a debug line for every request with its URL,
+	// status, duration and bytes sent and received.
+	Logger *slog.Logger `json:"-"`
+	// Progress is a convenience for a single subscriber. It is called before
+	// any ProgressSinks, which receive every update in registration order.
+	// Callbacks run synchronously on the test goroutines. Periodic updates may
+	// be dropped by a subscriber that cannot keep up, but each successful phase
+	// ends with exactly one update with Final set, which subscribers should
+	// always deliver.
+	Progress      func(ProgressUpdate)   `json:"-"`
+	ProgressSinks []func(ProgressUpdate) `json:"-"`
+
+	// trailingSlash is set during the run when the server only answers paths
+	// with a trailing slash.
+	trailingSlash bool
+	// maxDownloadBytes and maxUploadBytes are the per-request limits the
+	// server stated in /info, zero when it stated none.
+	maxDownloadBytes int64
+	maxUploadBytes   int64
+}
+
+func (c *ClientConfig) AddProgressSink(sink func(ProgressUpdate)) {
+	c.ProgressSinks = append(c.ProgressSinks, sink)
+}
+
+func (c ClientConfig) hasProgress() bool {
+	return c.Progress != nil || len(c.ProgressSinks) > 0
 }
 
 type ProgressUpdate struct {
@@ -38,22 +281,198 @@ type ProgressUpdate struct {
 	Percent float64
 	Mbps    float64
 	PingMs  float64
+	Final   bool
+	// Warmup is set while the phase is still in its unmeasured warmup.
+	Warmup bool
+	// Bytes is how much the download or upload has moved so far, warmup
+	// included, and TotalBytes how much it will move in all, or zero when
+	// the phase runs for a duration instead of a fixed amount.
+	Bytes      int64
+	TotalBytes int64
+	// ETA is the estimated time left in the phase, zero when unknown.
+	ETA time.Duration
 }
 
 type PingMetrics struct {
 	Min time.Duration
 	Avg time.Duration
-	P95 time.Duration
+	// Median is the middle sample, which a few outliers cannot drag the way
+	// they drag Avg and P95.
+	Median time.Duration
+	P95    time.Duration
+	// Jitter is the mean absolute difference between consecutive samples.
+	Jitter  time.Duration
+	Samples int
+	// Retransmits counts the ping requests that failed and were retried.
+	Retransmits int
+	// Unmarked is set when the first HTTP ping was answered without
+	// MarkerHeader, i.e. not by an ispeed server but perhaps by a captive
+	// portal, so the numbers may not describe the intended path.
+	Unmarked bool
+	// All holds every sample in the order it was taken.
+	All []time.Duration
+	// Conns is only filled in when ClientConfig.Trace is set.
+	Conns ConnStats
+	// Timing is only filled in when ClientConfig.ConnTrace is set.
+	Timing TimingBreakdown
+}
+
+// TimingBreakdown splits the first ping request, the one that opens the
+// connection, into its stages. A stage that did not happen, such as DNS for
+// an IP address or TLS over plain HTTP, is zero.
+type TimingBreakdown struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// TTFB runs from the request being written to the first response byte,
+	// i.e. one round trip plus the server's processing time.
+	TTFB time.Duration
+}
+
+// RampStep is the download rate one burst of the stream ramp reached.
+type RampStep struct {
+	Streams int
+	Mbps    float64
+}
+
+// TCPStats sums the kernel's TCP_INFO over the connections of a run, a ground
+// truth for link quality that application-level rates cannot show.
+type TCPStats struct {
+	// Conns is how many connections could be read; zero means no data.
+	Conns int
+	// Retransmits is the total number of segments the kernel retransmitted.
+	Retransmits int
+	// RTT is the mean of the kernel's smoothed round-trip time estimates.
+	RTT time.Duration
+}
+
+// ConnStats counts how many requests of a phase reused a kept-alive
+// connection and how many had to open a new one.
+type ConnStats struct {
+	Reused int
+	New    int
 }
 
 type SpeedMetrics struct {
-	Mbps     float64
+	// Mbps is Bytes over Duration: what moved after the warmup over the
+	// wall-clock time since it ended, or the whole phase without a warmup.
+	Mbps float64
+	// StreamSumMbps is the sum of each stream's bytes over that stream's own duration.
+	StreamSumMbps float64
+	// Bytes and Duration leave out the warmup, which Warmup gives the length
+	// of; it is zero when the phase ended before the warmup did. Per-stream
+	// rates cover each stream's whole lifetime.
 	Bytes    int64
 	Duration time.Duration
+	Warmup   time.Duration
+	Requests int
+	Streams  int
+	// StreamMbps holds each stream's own rate, in stream order, and
+	// StdDevMbps their population standard deviation. A high deviation means
+	// some streams were starved while others took most of the link.
+	StreamMbps []float64
+	StdDevMbps float64
+	// Protocol is the ALPN protocol negotiated for the connection, such as
+	// "h2" or "http/1.1". Only the download phase records it.
+	Protocol string
+	// StaticPayload is set when the upload repeated one buffer (StaticUpload or
+	// UploadData) instead of random data, which a compressing link can shrink.
+	StaticPayload bool
+	// ServerReportedMbps is the sum over the download streams of the sending
+	// rate the server reported, averaged over each stream's completed
+	// requests, when ClientConfig.ServerRate asked for it.
+	ServerReportedMbps float64
+	// LoadedPing is latency sampled while the phase saturated the link, and
+	// LoadedPingDelta its average minus the idle average (bufferbloat).
+	// Both are zero unless ClientConfig.Bufferbloat is set.
+	LoadedPing      PingMetrics
+	LoadedPingDelta time.Duration
+	// EchoBytes is how much of the upload the server echoed back, and EchoMbps
+	// the lower of the upload and echo rates, when ClientConfig.EchoUpload is set.
+	EchoBytes int64
+	EchoMbps  float64
+	// Conns is only filled in when ClientConfig.Trace is set.
+	Conns ConnStats
+	// Rejected counts upload requests the server answered with a non-2xx
+	// status. It is only non-zero with ClientConfig.PartialOK.
+	Rejected int
+	// Settled is set when adaptive stopping ended the phase early because
+	// its rate had stabilized.
+	Settled bool
+	// Samples is the throughput curve of the whole phase, warmup included,
+	// recorded every 200ms when ClientConfig.CollectSamples is set. The
+	// partial interval at the end of the phase is left out.
+	Samples []ThroughputSample
+}
+
+// ThroughputSample is one point of a phase's throughput curve: Bytes is the
+// total transferred Elapsed into the phase, and Mbps the rate since the
+// previous sample.
+type ThroughputSample struct {
+	Elapsed time.Duration
+	Bytes   int64
+	Mbps    float64
 }
 
 type Result struct {
 	Ping     PingMetrics
 	Download SpeedMetrics
 	Upload   SpeedMetrics
+	// DownloadHost is the host that served the download after redirects. When
+	// it differs from the BaseURL host, ping and download measured different
+	// machines.
+	DownloadHost string
+	// TCP is only filled in when ClientConfig.TCPInfo is set.
+	TCP TCPStats
+	// ServerInfo is what the server reported from /info before the test, or
+	// nil when it has no /info, in which case every endpoint is assumed.
+	ServerInfo *ServerInfo
+	// IPVersion is the address family of the first connection the run made,
+	// IPVersion4 or IPVersion6, or empty when no connection was opened.
+	IPVersion string
+	// Aborted is set when the average ping exceeded MaxStartupPing and the
+	// download and upload phases were skipped.
+	Aborted bool
+	// SmallTransferPenalty is how much longer the slowest tiny download took
+	// than a bare ping, when ClientConfig.SmallTransferProbe is set. It stays
+	// zero when the probe failed.
+	SmallTransferPenalty time.Duration
+	// RampProfile holds the rate of each burst when ClientConfig.RampStreams
+	// is set, and RampKnee the stream count past which more streams stopped
+	// raising the rate by at least 10%. RampErr records a ramp that failed;
+	// the test goes on without it and Complete does not count it.
+	RampProfile []RampStep
+	RampKnee    int
+	RampErr     error
+	// PingErr, DownloadErr and UploadErr record a phase that failed while the
+	// others went on; that phase's metrics are zero. RunClient only returns an
+	// error itself when every phase that ran failed.
+	PingErr     error
+	DownloadErr error
+	UploadErr   error
+	// Label is copied from ClientConfig.Label to tag the run.
+	Label string
+	// StartedAt and EndedAt bracket the whole run, from the first ping to the
+	// end of the upload. Config.BaseURL is the server that was measured.
+	StartedAt time.Time
+	EndedAt   time.Time
+	// Config is the configuration the run actually used, after defaults were
+	// applied, so a logged result records how it was produced. Callbacks and
+	// the UploadData payload are left out when it is marshaled to JSON.
+	Config ClientConfig
+	// Meta identifies the machine that ran the test. It is empty when
+	// ClientConfig.OmitMeta is set.
+	Meta Meta
+}
+
+// Complete reports whether every phase that ran succeeded.
+func (r Result) Complete() bool {
+	return r.PingErr == nil && r.DownloadErr == nil && r.UploadErr == nil
+}
+
+type Meta struct {
+	OS       string
+	Arch     string
+	Hostname string
+	Version  string
 }
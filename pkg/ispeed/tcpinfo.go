@@ -0,0 +1,93 @@
+package ispeed
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpSample is what one TCP_INFO read yields for a connection.
+type tcpSample struct {
+	retransmits int
+	rtt         time.Duration
+}
+
+// tcpCollector keeps every connection a run dials so the kernel's TCP_INFO
+// can be read from it, when it closes or at the end of the run.
+type tcpCollector struct {
+	mu    sync.Mutex
+	conns []*tcpInfoConn
+}
+
+// wrap returns dial with every connection it opens tracked by c. A nil dial
+// uses the same dialer settings as http.DefaultTransport.
+func (c *tcpCollector) wrap(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tracked := &tcpInfoConn{Conn: conn}
+		c.mu.Lock()
+		c.conns = append(c.conns, tracked)
+		c.mu.Unlock()
+		return tracked, nil
+	}
+}
+
+// stats sums the tracked connections. Without a collector, or where TCP_INFO
+// cannot be read, it reports zero connections.
+func (c *tcpCollector) stats() TCPStats {
+	if c == nil {
+		return TCPStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stats TCPStats
+	var rtt time.Duration
+	for _, conn := range c.conns {
+		sample, ok := conn.sample()
+		if !ok {
+			continue
+		}
+		stats.Conns++
+		stats.Retransmits += sample.retransmits
+		rtt += sample.rtt
+	}
+	if stats.Conns > 0 {
+		stats.RTT = rtt / time.Duration(stats.Conns)
+	}
+	return stats
+}
+
+type tcpInfoConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool
+	last   tcpSample
+	ok     bool
+}
+
+// Close takes a last TCP_INFO reading, since the socket is gone afterwards.
+func (c *tcpInfoConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.last, c.ok = readTCPInfo(c.Conn)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *tcpInfoConn) sample() (tcpSample, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.last, c.ok
+	}
+	return readTCPInfo(c.Conn)
+}
@@ -0,0 +1,33 @@
+package ispeed
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo reads the kernel's counters for conn with getsockopt(TCP_INFO).
+func readTCPInfo(conn net.Conn) (tcpSample, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return tcpSample{}, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return tcpSample{}, false
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	err = raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || infoErr != nil {
+		return tcpSample{}, false
+	}
+	return tcpSample{
+		retransmits: int(info.Total_retrans),
+		rtt:         time.Duration(info.Rtt) * time.Microsecond,
+	}, true
+}
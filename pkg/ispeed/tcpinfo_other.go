@@ -0,0 +1,11 @@
+//go:build !linux
+
+package ispeed
+
+import "net"
+
+// readTCPInfo has no portable equivalent outside Linux, so TCPStats stays
+// empty there.
+func readTCPInfo(net.Conn) (tcpSample, bool) {
+	return tcpSample{}, false
+}
@@ -0,0 +1,189 @@
+package ispeed
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleConnsSpare leaves room in the pool for the ping and loaded-ping
+// requests that run next to the streams.
+const idleConnsSpare = 2
+
+func newHTTPClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The default keeps only 2 idle connections per host, so with more streams
+	// every request after the first few dials a new connection, which costs
+	// noticeable throughput at 8 streams and up. Size the pool to the streams.
+	perHost := max(cfg.DownloadStreams, cfg.UploadStreams, cfg.Streams) + idleConnsSpare
+	transport.MaxIdleConnsPerHost = perHost
+	transport.MaxIdleConns = max(transport.MaxIdleConns, perHost)
+
+	if cfg.CAFile != "" {
+		pool, err := loadCAFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if cfg.ForceHTTP1 {
+		// A non-nil, empty TLSNextProto keeps the transport from upgrading to h2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if cfg.DialContext != nil {
+		transport.DialContext = cfg.DialContext
+	}
+	if network := ipNetwork(cfg.IPVersion); network != "tcp" {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	}
+	if cfg.ProxyURL != "" {
+		proxy, err := parseProxyURL(cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.Logger != nil {
+		return &http.Client{Timeout: cfg.Timeout, Transport: &loggingTransport{Transport: transport, logger: cfg.Logger}}, nil
+	}
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}, nil
+}
+
+// loggingTransport logs one debug line per request once its response body is
+// closed, so the duration and byte counts cover the whole transfer.
+type loggingTransport struct {
+	*http.Transport
+	logger *slog.Logger
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var sent int64
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = &countingBody{ReadCloser: req.Body, total: &sent}
+	}
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		t.logger.Debug("request failed", "method", req.Method, "url", req.URL.String(),
+			"duration", time.Since(start), "sent", atomic.LoadInt64(&sent), "err", err)
+		return nil, err
+	}
+	var received int64
+	resp.Body = &countingBody{ReadCloser: resp.Body, total: &received, onClose: func() {
+		t.logger.Debug("request", "method", req.Method, "url", req.URL.String(), "status", resp.StatusCode,
+			"duration", time.Since(start), "sent", atomic.LoadInt64(&sent), "received", atomic.LoadInt64(&received))
+	}}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	total   *int64
+	onClose func()
+	once    sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.total, int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return err
+}
+
+// baseTransport returns the *http.Transport under client, if any.
+func baseTransport(client *http.Client) (*http.Transport, bool) {
+	switch transport := client.Transport.(type) {
+	case *http.Transport:
+		return transport, true
+	case *loggingTransport:
+		return transport.Transport, true
+	}
+	return nil, false
+}
+
+func ipNetwork(version string) string {
+	switch version {
+	case IPVersion4:
+		return "tcp4"
+	case IPVersion6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// traceIPVersion records the address family of the first connection made with
+// the returned context.
+func traceIPVersion(ctx context.Context) (context.Context, func() string) {
+	var version atomic.Value
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				return
+			}
+			if addr.IP.To4() != nil {
+				version.CompareAndSwap(nil, IPVersion4)
+			} else {
+				version.CompareAndSwap(nil, IPVersion6)
+			}
+		},
+	})
+	return ctx, func() string {
+		v, _ := version.Load().(string)
+		return v
+	}
+}
+
+// parseProxyURL accepts the schemes net/http can proxy through: http, https
+// and socks5 (socks5h resolves names on the proxy).
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be http, https, socks5 or socks5h", raw)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("proxy %q: missing host", raw)
+	}
+	return proxy, nil
+}
+
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA file %s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
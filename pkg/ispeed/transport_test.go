@@ -0,0 +1,185 @@
+package ispeed
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// writeCAFile stores the certificate of a TLS test server as a PEM bundle.
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(ServerHandler(ServerConfig{}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.CAFile = writeCAFile(t, server)
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL + "/ping")
+	if err != nil {
+		t.Fatalf("GET with the server's CA trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	// The system roots do not know the test CA.
+	cfg.CAFile = ""
+	client, err = newHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(server.URL + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Fatal("GET without the CA succeeded, want a certificate error")
+	}
+}
+
+func TestCAFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("-----BEGIN NOTHING-----\nnot base64\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		path string
+		want string
+	}{
+		{"unparsable", garbage, "no PEM certificates"},
+		{"missing", filepath.Join(dir, "missing.pem"), "missing.pem"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("https://127.0.0.1")
+			cfg.CAFile = tt.path
+			_, err := newHTTPClient(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiatedProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		http2      bool
+		forceHTTP1 bool
+		want       string
+	}{
+		{"h2", true, false, "h2"},
+		{"h1 server", false, false, "http/1.1"},
+		{"h1 forced", true, true, "http/1.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(ServerHandler(ServerConfig{}))
+			server.EnableHTTP2 = tt.http2
+			server.StartTLS()
+			defer server.Close()
+
+			cfg := testConfig(server.URL)
+			cfg.CAFile = writeCAFile(t, server)
+			cfg.ForceHTTP1 = tt.forceHTTP1
+			cfg, err := normalizeClientConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := newHTTPClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := runDownload(context.Background(), client, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Protocol != tt.want {
+				t.Errorf("Protocol = %q, want %q", res.Protocol, tt.want)
+			}
+		})
+	}
+}
+
+// pipeListener hands the server ends of in-memory connections to an
+// http.Server, so a test can run without any network.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func (l *pipeListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDialContextInMemory(t *testing.T) {
+	listener := newPipeListener()
+	server := &http.Server{Handler: ServerHandler(ServerConfig{})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	var dials int64
+	cfg := testConfig("http://in-memory.invalid")
+	cfg.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&dials, 1)
+		return listener.dial(ctx, network, addr)
+	}
+	result, err := RunClientContext(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete() || result.Download.Bytes == 0 || result.Upload.Bytes == 0 {
+		t.Errorf("result over the pipe: complete %v, %d bytes down, %d up", result.Complete(), result.Download.Bytes, result.Upload.Bytes)
+	}
+	if atomic.LoadInt64(&dials) == 0 {
+		t.Error("the custom dialer was never used")
+	}
+}
@@ -0,0 +1,65 @@
+package ispeed
+
+import "time"
+
+// verdictTier is the minimum a connection needs for one verdict. A zero
+// latency or loss limit means the tier does not look at it.
+type verdictTier struct {
+	minDownloadMbps float64
+	minUploadMbps   float64
+	maxPing         time.Duration
+	maxJitter       time.Duration
+	maxLoss         float64
+	text            string
+}
+
+// verdictTiers are checked in order and the first one the result meets wins.
+// The throughput limits follow common streaming guidance (about 25 Mbps for
+// 4K, 5 Mbps for HD) and the latency limits what interactive calls and games
+// tolerate before they feel laggy. Calls start to break up at a few percent
+// of packet loss.
+var verdictTiers = []verdictTier{
+	{100, 20, 30 * time.Millisecond, 10 * time.Millisecond, 0.01, "Excellent for 4K streaming, gaming and video calls"},
+	{25, 5, 60 * time.Millisecond, 30 * time.Millisecond, 0.02, "Great for 4K streaming and video calls"},
+	{10, 2, 100 * time.Millisecond, 50 * time.Millisecond, 0.05, "Good for HD streaming and video calls"},
+	{5, 1, 200 * time.Millisecond, 0, 0, "Okay for browsing and SD streaming"},
+}
+
+const poorVerdict = "Poor: expect slow pages and choppy calls"
+
+// Verdict sums up a result in one line for people who do not want to read
+// the numbers. Latency is the median ping, so one lucky sample cannot lift a
+// laggy link. Latency and loss limits are skipped when the ping phase was.
+func Verdict(result Result) string {
+	if result.Aborted {
+		return poorVerdict
+	}
+	measuredPing := result.Ping.Samples > 0
+	loss := pingLoss(result.Ping)
+	for _, tier := range verdictTiers {
+		if result.Download.Mbps < tier.minDownloadMbps || result.Upload.Mbps < tier.minUploadMbps {
+			continue
+		}
+		if measuredPing && tier.maxPing > 0 && result.Ping.Median > tier.maxPing {
+			continue
+		}
+		if measuredPing && tier.maxJitter > 0 && result.Ping.Jitter > tier.maxJitter {
+			continue
+		}
+		if measuredPing && tier.maxLoss > 0 && loss > tier.maxLoss {
+			continue
+		}
+		return tier.text
+	}
+	return poorVerdict
+}
+
+// pingLoss is the fraction of ping requests that failed and had to be
+// retried, the closest the HTTP ping comes to packet loss.
+func pingLoss(ping PingMetrics) float64 {
+	attempts := ping.Samples + ping.Retransmits
+	if attempts == 0 {
+		return 0
+	}
+	return float64(ping.Retransmits) / float64(attempts)
+}
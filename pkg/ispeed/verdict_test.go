@@ -0,0 +1,46 @@
+package ispeed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerdict(t *testing.T) {
+	result := func(download, upload float64, ping, jitter time.Duration, samples, retransmits int) Result {
+		return Result{
+			Download: SpeedMetrics{Mbps: download},
+			Upload:   SpeedMetrics{Mbps: upload},
+			Ping:     PingMetrics{Min: ping / 2, Median: ping, Jitter: jitter, Samples: samples, Retransmits: retransmits},
+		}
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		result Result
+		want   string
+	}{
+		{"excellent", result(500, 50, 10*ms, 2*ms, 100, 0), verdictTiers[0].text},
+		{"great on throughput", result(50, 10, 10*ms, 2*ms, 100, 0), verdictTiers[1].text},
+		{"great on ping", result(500, 50, 50*ms, 2*ms, 100, 0), verdictTiers[1].text},
+		{"good on jitter", result(500, 50, 10*ms, 40*ms, 100, 0), verdictTiers[2].text},
+		{"good on loss", result(500, 50, 10*ms, 2*ms, 97, 3), verdictTiers[2].text},
+		{"okay ignores loss", result(500, 50, 10*ms, 2*ms, 90, 10), verdictTiers[3].text},
+		{"okay", result(6, 1.5, 150*ms, 80*ms, 100, 0), verdictTiers[3].text},
+		{"poor throughput", result(2, 0.5, 10*ms, 2*ms, 100, 0), poorVerdict},
+		{"poor ping", result(500, 50, 300*ms, 2*ms, 100, 0), poorVerdict},
+		{"lucky fastest ping", Result{
+			Download: SpeedMetrics{Mbps: 500},
+			Upload:   SpeedMetrics{Mbps: 50},
+			Ping:     PingMetrics{Min: 5 * ms, Median: 300 * ms, Samples: 10},
+		}, poorVerdict},
+		{"ping skipped", result(500, 50, 0, 0, 0, 0), verdictTiers[0].text},
+		{"aborted", Result{Aborted: true}, poorVerdict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verdict(tt.result); got != tt.want {
+				t.Errorf("Verdict = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package ispeed
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runWebSocketPing times PingCount echoes over one WebSocket connection to
+// /ws-ping. Only the handshake pays for connection setup, so the samples are
+// closer to the bare round trip than HTTP pings on a fresh or busy pool.
+func runWebSocketPing(ctx context.Context, client *http.Client, cfg ClientConfig) (PingMetrics, error) {
+	dialer := websocketDialer(client, cfg)
+	conn, resp, err := dialer.DialContext(ctx, websocketURL(cfg.BaseURL)+"/ws-ping", nil)
+	if err != nil {
+		if resp != nil {
+			return PingMetrics{}, newStatusError("websocket ping", resp, false)
+		}
+		return PingMetrics{}, &ConnError{Op: "websocket ping", Err: err}
+	}
+	defer conn.Close()
+	// Unblock a pending read when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	results := make([]time.Duration, 0, cfg.PingCount)
+	frame := make([]byte, 8)
+	for i := 0; i < cfg.PingCount; i++ {
+		sent := time.Now()
+		binary.BigEndian.PutUint64(frame, uint64(sent.UnixNano()))
+		_ = conn.SetWriteDeadline(sent.Add(cfg.Timeout))
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return PingMetrics{}, pingContextErr(ctx, err)
+		}
+		_ = conn.SetReadDeadline(sent.Add(cfg.Timeout))
+		_, echo, err := conn.ReadMessage()
+		if err != nil {
+			return PingMetrics{}, pingContextErr(ctx, err)
+		}
+		sample := time.Since(sent)
+		if len(echo) != len(frame) || binary.BigEndian.Uint64(echo) != uint64(sent.UnixNano()) {
+			return PingMetrics{}, errors.New("websocket ping: echo does not match the frame sent")
+		}
+
+		results = append(results, sample)
+		if i == cfg.PingCount-1 {
+			reportFinalProgress(cfg, "ping", 0, sample.Seconds()*1000)
+		} else {
+			reportProgress(cfg, ProgressUpdate{Phase: "ping", Percent: float64(i+1) / float64(cfg.PingCount) * 100, PingMs: sample.Seconds() * 1000})
+			select {
+			case <-time.After(cfg.PingInterval):
+			case <-ctx.Done():
+				return PingMetrics{}, ctx.Err()
+			}
+		}
+	}
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return pingMetrics(results), nil
+}
+
+// websocketDialer connects the way client does, with the same dialer, proxy
+// and TLS settings, so -cacert and DialContext apply to WebSocket pings too.
+func websocketDialer(client *http.Client, cfg ClientConfig) *websocket.Dialer {
+	dialer := &websocket.Dialer{HandshakeTimeout: cfg.Timeout, Proxy: http.ProxyFromEnvironment}
+	if transport, ok := baseTransport(client); ok {
+		dialer.NetDialContext = transport.DialContext
+		dialer.Proxy = transport.Proxy
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	return dialer
+}
+
+func websocketURL(baseURL string) string {
+	switch {
+	case strings.HasPrefix(baseURL, "https://"):
+		return "wss://" + strings.TrimPrefix(baseURL, "https://")
+	case strings.HasPrefix(baseURL, "http://"):
+		return "ws://" + strings.TrimPrefix(baseURL, "http://")
+	}
+	return baseURL
+}
+
+// pingContextErr prefers ctx.Err() over the error a cancelled connection
+// produced, so callers can tell a cancel from a network failure.
+func pingContextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return fmt.Errorf("websocket ping: %w", err)
+}
+
+var pingUpgrader = websocket.Upgrader{
+	// The ping carries no credentials, so any page may open it.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handleWebSocketPing echoes every frame back unchanged, after the simulated
+// latency when one is configured.
+func handleWebSocketPing(w http.ResponseWriter, r *http.Request, cfg ServerConfig) {
+	conn, err := pingUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if cfg.SimLatency > 0 {
+			time.Sleep(cfg.SimLatency)
+		}
+		if err := conn.WriteMessage(kind, data); err != nil {
+			return
+		}
+	}
+}
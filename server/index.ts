@@ -2,6 +2,8 @@ const DEFAULT_PORT = 8080;
 const DEFAULT_MAX_BYTES = 1024 * 1024 * 1024;
 const DEFAULT_READ_LIMIT = 512 * 1024 * 1024;
 const DEFAULT_CHUNK_SIZE = 64 * 1024;
+const MARKER_HEADER = "X-Ispeed";
+const VERSION = "dev";
 
 function parseSizeParam(request: Request, maxBytes: number): number {
   const url = new URL(request.url);
@@ -71,6 +73,12 @@ function handlePing(): Response {
 }
 
 async function handler(request: Request): Promise<Response> {
+  const response = await route(request);
+  response.headers.set(MARKER_HEADER, VERSION);
+  return response;
+}
+
+async function route(request: Request): Promise<Response> {
   const url = new URL(request.url);
   if (url.pathname === "/ping") {
     return handlePing();
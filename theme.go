@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+const (
+	themeAuto  = "auto"
+	themeDark  = "dark"
+	themeLight = "light"
+)
+
+// palette holds the colors of the interactive UI and its summary table.
+type palette struct {
+	title   lipgloss.TerminalColor
+	muted   lipgloss.TerminalColor
+	label   lipgloss.TerminalColor
+	accent  lipgloss.TerminalColor
+	failure lipgloss.TerminalColor
+	border  lipgloss.TerminalColor
+	verdict lipgloss.TerminalColor
+	// barFrom and barTo are the ends of the progress bar gradient.
+	barFrom string
+	barTo   string
+}
+
+var darkPalette = palette{
+	title:   lipgloss.Color("69"),
+	muted:   lipgloss.Color("245"),
+	label:   lipgloss.Color("252"),
+	accent:  lipgloss.Color("51"),
+	failure: lipgloss.Color("196"),
+	border:  lipgloss.Color("240"),
+	verdict: lipgloss.Color("213"),
+	barFrom: "#5A56E0",
+	barTo:   "#00D7FF",
+}
+
+// lightPalette swaps the near-white label and the pale cyan accent, which
+// vanish on a light background, for darker shades.
+var lightPalette = palette{
+	title:   lipgloss.Color("26"),
+	muted:   lipgloss.Color("242"),
+	label:   lipgloss.Color("235"),
+	accent:  lipgloss.Color("31"),
+	failure: lipgloss.Color("160"),
+	border:  lipgloss.Color("248"),
+	verdict: lipgloss.Color("127"),
+	barFrom: "#3B37B0",
+	barTo:   "#0087AF",
+}
+
+// colors is the palette in use; applyTheme sets it before the UI starts.
+var colors = darkPalette
+
+func validTheme(theme string) bool {
+	return theme == themeAuto || theme == themeDark || theme == themeLight
+}
+
+// applyTheme picks the palette for theme, asking the terminal for its
+// background under themeAuto, and turns styling off entirely with noColor.
+// NO_COLOR and output that is not a terminal already turn it off through
+// lipgloss's own detection.
+func applyTheme(theme string, noColor bool) {
+	if noColor {
+		lipgloss.SetColorProfile(termenv.Ascii)
+		return
+	}
+	switch theme {
+	case themeLight:
+		colors = lightPalette
+	case themeAuto:
+		if !lipgloss.HasDarkBackground() {
+			colors = lightPalette
+		}
+	}
+}